@@ -145,7 +145,7 @@ func TestMuxerWithWriter(t *testing.T) {
 		PTS:         0,
 		DTS:         0,
 		Duration:    1,
-		Flags:       "K__",
+		Flags:       PacketKeyframe,
 	}
 
 	err = muxer.WritePacket(packet)
@@ -1,10 +1,12 @@
 package avi
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"time"
 )
 
@@ -85,6 +87,15 @@ func (r *Reader) parseChunks() error {
 	fileInfo.Filename = r.filename
 	fileInfo.FileSize = r.fileSize
 
+	r.moviOffset = 0
+	r.segments = nil
+	r.index = nil
+	r.indexByPosition = nil
+	r.superIndexes = nil
+	r.odmlIndex = nil
+	r.timing = nil
+	r.recovered = false
+
 	// Skip to after RIFF header
 	if _, err := r.r.Seek(12, io.SeekStart); err != nil {
 		return &AVIError{Op: "seek", Err: err}
@@ -116,10 +127,26 @@ func (r *Reader) parseChunks() error {
 				return err
 			}
 		case IDX1Chunk:
-			// Parse index for packet reading
-			if err := r.parseIDX1Chunk(header.Size); err != nil {
+			// Parse index for packet reading, keeping the complete entries
+			// of an index cut off by the end of the file
+			size := header.Size
+			if pos+8+int64(size) > r.fileSize {
+				size = uint32(r.fileSize - pos - 8)
+			}
+			if err := r.parseIDX1Chunk(size); err != nil {
 				return err
 			}
+		case RIFFSignature:
+			// OpenDML continuation, its lists are parsed as top-level chunks
+			var riffType [4]byte
+			if err := binary.Read(r.r, binary.LittleEndian, &riffType); err != nil {
+				return &AVIError{Op: "read riff type", Err: err}
+			}
+			if string(riffType[:]) != AVIXSignature {
+				if _, err := r.r.Seek(int64(AlignSize(header.Size))-4, io.SeekCurrent); err != nil {
+					return &AVIError{Op: "skip riff", Err: err}
+				}
+			}
 		default:
 			// Skip unknown chunks
 			if _, err := r.r.Seek(int64(AlignSize(header.Size)), io.SeekCurrent); err != nil {
@@ -128,10 +155,19 @@ func (r *Reader) parseChunks() error {
 		}
 	}
 
+	// The OpenDML indexes cover every RIFF segment while idx1 only
+	// covers the first one, so they take precedence when present
+	if err := r.loadOpenDMLIndexes(); err != nil {
+		return err
+	}
+
+	r.splitDVStreams(&streams)
+
 	r.streams = streams
 	r.fileInfo = &fileInfo
 	r.fileInfo.Streams = streams
-	
+	r.resetPlayback()
+
 	// Count stream types
 	for _, stream := range streams {
 		switch stream.Type {
@@ -139,6 +175,10 @@ func (r *Reader) parseChunks() error {
 			r.fileInfo.VideoStreams++
 		case StreamTypeAudio:
 			r.fileInfo.AudioStreams++
+		case StreamTypeSubtitle:
+			r.fileInfo.SubtitleStreams++
+		case StreamTypeData:
+			r.fileInfo.DataStreams++
 		}
 	}
 
@@ -158,13 +198,27 @@ func (r *Reader) parseLISTChunk(size uint32, streams *[]Stream, fileInfo *FileIn
 	switch listTypeStr {
 	case HDRLList:
 		return r.parseHDRLList(remainingSize, streams, fileInfo)
+	case INFOList:
+		return r.parseINFOList(remainingSize, fileInfo)
 	case MOVIList:
 		// Store movi offset for packet reading
 		// Current position is after reading "movi" signature, so we need to subtract 4
 		currentPos, _ := r.r.Seek(0, io.SeekCurrent)
-		r.moviOffset = currentPos - 4 // Subtract the "movi" signature we just read
+		segment := moviSegment{start: currentPos - 4, end: currentPos - 4 + int64(size)}
+		next := segment.start + int64(AlignSize(size))
+		if segment.end > r.fileSize || size < 4 {
+			// Truncated capture or a size never patched by the writer,
+			// read what is there
+			segment.end = r.fileSize
+			next = r.fileSize
+		}
+		if len(r.segments) == 0 {
+			// idx1 offsets are relative to the first movi list
+			r.moviOffset = segment.start // Subtract the "movi" signature we just read
+		}
+		r.segments = append(r.segments, segment)
 		// Skip movi list data for now
-		if _, err := r.r.Seek(int64(AlignSize(remainingSize)), io.SeekCurrent); err != nil {
+		if _, err := r.r.Seek(next, io.SeekStart); err != nil {
 			return &AVIError{Op: "skip movi", Err: err}
 		}
 	default:
@@ -207,8 +261,29 @@ func (r *Reader) parseHDRLList(size uint32, streams *[]Stream, fileInfo *FileInf
 				return err
 			}
 		case LISTSignature:
-			if err := r.parseSTRLList(header.Size, streams); err != nil {
-				return err
+			var listType [4]byte
+			if err := binary.Read(r.r, binary.LittleEndian, &listType); err != nil {
+				return &AVIError{Op: "read hdrl list type", Err: err}
+			}
+
+			switch string(listType[:]) {
+			case STRLList:
+				if err := r.parseSTRLList(header.Size-4, streams); err != nil {
+					return err
+				}
+			case ODMLList:
+				if err := r.parseODMLList(header.Size-4, fileInfo); err != nil {
+					return err
+				}
+			case INFOList:
+				if err := r.parseINFOList(header.Size-4, fileInfo); err != nil {
+					return err
+				}
+			default:
+				// Skip unknown list
+				if _, err := r.r.Seek(int64(AlignSize(header.Size-4)), io.SeekCurrent); err != nil {
+					return &AVIError{Op: "skip hdrl list", Err: err}
+				}
 			}
 		default:
 			// Skip unknown chunk
@@ -221,6 +296,51 @@ func (r *Reader) parseHDRLList(size uint32, streams *[]Stream, fileInfo *FileInf
 	return nil
 }
 
+// parseINFOList reads the tags of an INFO list, size excludes the list type
+func (r *Reader) parseINFOList(size uint32, fileInfo *FileInfo) error {
+	start, err := r.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get info position", Err: err}
+	}
+	end := start + int64(size)
+	if end > r.fileSize {
+		end = r.fileSize
+	}
+
+	for pos := start; pos+8 <= end; {
+		var header ChunkHeader
+		if err := binary.Read(r.r, binary.LittleEndian, &header); err != nil {
+			return &AVIError{Op: "read info chunk", Err: err}
+		}
+		if pos+8+int64(header.Size) > end {
+			break
+		}
+
+		value := make([]byte, header.Size)
+		if _, err := io.ReadFull(r.r, value); err != nil {
+			return &AVIError{Op: "read info tag", Err: err}
+		}
+		if i := bytes.IndexByte(value, 0); i >= 0 {
+			value = value[:i]
+		}
+
+		if fileInfo.Metadata == nil {
+			fileInfo.Metadata = make(map[string]string)
+		}
+		fileInfo.Metadata[ChunkIDToString(header.ID)] = string(value)
+
+		pos += 8 + int64(AlignSize(header.Size))
+		if _, err := r.r.Seek(pos, io.SeekStart); err != nil {
+			return &AVIError{Op: "skip info tag", Err: err}
+		}
+	}
+
+	if _, err := r.r.Seek(start+int64(AlignSize(size)), io.SeekStart); err != nil {
+		return &AVIError{Op: "skip info list", Err: err}
+	}
+	return nil
+}
+
 // parseAVIHChunk parses the main AVI header
 func (r *Reader) parseAVIHChunk(size uint32, fileInfo *FileInfo) error {
 	var header AVIMainHeader
@@ -228,6 +348,9 @@ func (r *Reader) parseAVIHChunk(size uint32, fileInfo *FileInfo) error {
 		return &AVIError{Op: "read avih", Err: err}
 	}
 
+	r.microSecPerFrame = header.MicroSecPerFrame
+	fileInfo.MaxBytesPerSec = int(header.MaxBytesPerSec)
+	fileInfo.SuggestedBufferSize = int(header.SuggestedBufferSize)
 	if header.MicroSecPerFrame > 0 {
 		fileInfo.Duration = time.Duration(header.TotalFrames) * time.Duration(header.MicroSecPerFrame) * time.Microsecond
 	}
@@ -242,29 +365,19 @@ func (r *Reader) parseAVIHChunk(size uint32, fileInfo *FileInfo) error {
 	return nil
 }
 
-// parseSTRLList parses a stream list
+// parseSTRLList parses a stream list, size excludes the list type
 func (r *Reader) parseSTRLList(size uint32, streams *[]Stream) error {
-	var listType [4]byte
-	if err := binary.Read(r.r, binary.LittleEndian, &listType); err != nil {
-		return &AVIError{Op: "read strl type", Err: err}
-	}
-
-	if string(listType[:]) != STRLList {
-		// Skip if not a stream list
-		if _, err := r.r.Seek(int64(AlignSize(size-4)), io.SeekCurrent); err != nil {
-			return &AVIError{Op: "skip non-strl", Err: err}
-		}
-		return nil
-	}
-
 	var stream Stream
 	stream.Index = len(*streams)
+	r.timing = append(r.timing, streamTiming{})
+
+	var superIndex []AVISuperIndexEntry
 
 	endPos, err := r.r.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return &AVIError{Op: "get strl position", Err: err}
 	}
-	endPos += int64(size - 4)
+	endPos += int64(size)
 
 	for {
 		pos, err := r.r.Seek(0, io.SeekCurrent)
@@ -291,8 +404,29 @@ func (r *Reader) parseSTRLList(size uint32, streams *[]Stream) error {
 			if err := r.parseSTRFChunk(header.Size, &stream); err != nil {
 				return err
 			}
+		case STRNChunk, STRDChunk:
+			data := make([]byte, header.Size)
+			if _, err := io.ReadFull(r.r, data); err != nil {
+				return &AVIError{Op: "read " + chunkID, Err: err}
+			}
+			if err := r.skipPadding(header.Size); err != nil {
+				return err
+			}
+			if chunkID == STRDChunk {
+				stream.DriverData = data
+			} else if end := bytes.IndexByte(data, 0); end >= 0 {
+				stream.Name = string(data[:end])
+			} else {
+				stream.Name = string(data)
+			}
+		case INDXChunk:
+			entries, err := r.parseINDXChunk(header.Size)
+			if err != nil {
+				return err
+			}
+			superIndex = entries
 		default:
-			// Skip unknown chunk (strn, strd, etc.)
+			// Skip unknown chunk
 			if _, err := r.r.Seek(int64(AlignSize(header.Size)), io.SeekCurrent); err != nil {
 				return &AVIError{Op: "skip strl chunk", Err: err}
 			}
@@ -300,15 +434,234 @@ func (r *Reader) parseSTRLList(size uint32, streams *[]Stream) error {
 	}
 
 	*streams = append(*streams, stream)
+	r.superIndexes = append(r.superIndexes, superIndex)
+	return nil
+}
+
+// parseODMLList parses the OpenDML extended header list
+func (r *Reader) parseODMLList(size uint32, fileInfo *FileInfo) error {
+	endPos, err := r.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get odml position", Err: err}
+	}
+	endPos += int64(size)
+
+	for {
+		pos, err := r.r.Seek(0, io.SeekCurrent)
+		if err != nil || pos+8 > endPos {
+			break
+		}
+
+		var header ChunkHeader
+		if err := binary.Read(r.r, binary.LittleEndian, &header); err != nil {
+			return &AVIError{Op: "read odml chunk", Err: err}
+		}
+
+		if ChunkIDToString(header.ID) == DMLHChunk && header.Size >= 4 {
+			var totalFrames uint32
+			if err := binary.Read(r.r, binary.LittleEndian, &totalFrames); err != nil {
+				return &AVIError{Op: "read dmlh", Err: err}
+			}
+			// avih only counts the frames of the first RIFF segment
+			if totalFrames > 0 && r.microSecPerFrame > 0 {
+				fileInfo.Duration = time.Duration(totalFrames) * time.Duration(r.microSecPerFrame) * time.Microsecond
+			}
+			header.Size -= 4
+		}
+
+		if _, err := r.r.Seek(int64(AlignSize(header.Size)), io.SeekCurrent); err != nil {
+			return &AVIError{Op: "skip odml chunk", Err: err}
+		}
+	}
+
+	if _, err := r.r.Seek(endPos, io.SeekStart); err != nil {
+		return &AVIError{Op: "skip odml list", Err: err}
+	}
+
+	return nil
+}
+
+// parseINDXChunk parses a stream's OpenDML indx chunk. Super indexes are
+// returned for loading once the whole file has been walked; the rarer indx
+// holding chunk entries directly is collected straight away.
+func (r *Reader) parseINDXChunk(size uint32) ([]AVISuperIndexEntry, error) {
+	start, err := r.r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, &AVIError{Op: "get indx position", Err: err}
+	}
+
+	var header AVIMetaIndex
+	if err := binary.Read(r.r, binary.LittleEndian, &header); err != nil {
+		return nil, &AVIError{Op: "read indx header", Err: err}
+	}
+
+	var entries []AVISuperIndexEntry
+	switch header.IndexType {
+	case AVIIndexOfIndexes:
+		// Skip dwReserved[3]
+		if _, err := r.r.Seek(12, io.SeekCurrent); err != nil {
+			return nil, &AVIError{Op: "skip indx reserved", Err: err}
+		}
+		if header.LongsPerEntry != 4 || int64(header.EntriesInUse)*16 > int64(size)-24 {
+			return nil, &AVIError{Op: "read indx", Err: fmt.Errorf("invalid super index (%d entries of %d longs)", header.EntriesInUse, header.LongsPerEntry)}
+		}
+		entries = make([]AVISuperIndexEntry, header.EntriesInUse)
+		if err := binary.Read(r.r, binary.LittleEndian, entries); err != nil {
+			return nil, &AVIError{Op: "read indx entries", Err: err}
+		}
+	case AVIIndexOfChunks:
+		records, err := r.parseStdIndex(header, size)
+		if err != nil {
+			return nil, err
+		}
+		r.odmlIndex = append(r.odmlIndex, records...)
+	}
+
+	// Super indexes reserve room for more entries than are in use
+	if _, err := r.r.Seek(start+int64(AlignSize(size)), io.SeekStart); err != nil {
+		return nil, &AVIError{Op: "skip indx remainder", Err: err}
+	}
+
+	return entries, nil
+}
+
+// parseStdIndex reads the entries of a standard or field index whose
+// AVIMetaIndex header has just been read
+func (r *Reader) parseStdIndex(header AVIMetaIndex, size uint32) ([]indexRecord, error) {
+	var baseOffset uint64
+	if err := binary.Read(r.r, binary.LittleEndian, &baseOffset); err != nil {
+		return nil, &AVIError{Op: "read std index base", Err: err}
+	}
+	// Skip dwReserved3
+	if _, err := r.r.Seek(4, io.SeekCurrent); err != nil {
+		return nil, &AVIError{Op: "skip std index reserved", Err: err}
+	}
+
+	// Field indexes carry the offset of the second field as a third DWORD
+	entrySize := int64(header.LongsPerEntry) * 4
+	if entrySize < 8 || int64(header.EntriesInUse)*entrySize > int64(size)-24 {
+		return nil, &AVIError{Op: "read std index", Err: fmt.Errorf("invalid standard index (%d entries of %d longs)", header.EntriesInUse, header.LongsPerEntry)}
+	}
+
+	data := make([]byte, int64(header.EntriesInUse)*entrySize)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, &AVIError{Op: "read std index entries", Err: err}
+	}
+
+	records := make([]indexRecord, 0, header.EntriesInUse)
+	for i := int64(0); i < int64(header.EntriesInUse); i++ {
+		entry := AVIStdIndexEntry{
+			Offset: binary.LittleEndian.Uint32(data[i*entrySize:]),
+			Size:   binary.LittleEndian.Uint32(data[i*entrySize+4:]),
+		}
+
+		var flags uint32 = AVIIFKeyframe
+		if entry.Size&AVIStdIndexDeltaFrame != 0 {
+			flags = 0
+		}
+
+		records = append(records, indexRecord{
+			chunkID:  header.ChunkID,
+			flags:    flags,
+			position: int64(baseOffset) + int64(entry.Offset) - 8, // Offset points past the chunk header
+			size:     entry.Size &^ AVIStdIndexDeltaFrame,
+		})
+	}
+
+	return records, nil
+}
+
+// loadOpenDMLIndexes reads the ix## chunks referenced by the super indexes
+// and replaces the idx1 based index with them
+func (r *Reader) loadOpenDMLIndexes() error {
+	for _, entries := range r.superIndexes {
+		for _, entry := range entries {
+			if int64(entry.Offset)+32 > r.fileSize {
+				// Points past the end of a truncated file
+				continue
+			}
+
+			if _, err := r.r.Seek(int64(entry.Offset), io.SeekStart); err != nil {
+				return &AVIError{Op: "seek to std index", Err: err}
+			}
+
+			var chunk ChunkHeader
+			if err := binary.Read(r.r, binary.LittleEndian, &chunk); err != nil {
+				return &AVIError{Op: "read std index chunk", Err: err}
+			}
+
+			if chunk.ID[0] != 'i' || chunk.ID[1] != 'x' {
+				// Stale super index entry, the data is still reachable through ReadPacket
+				continue
+			}
+
+			var header AVIMetaIndex
+			if err := binary.Read(r.r, binary.LittleEndian, &header); err != nil {
+				return &AVIError{Op: "read std index header", Err: err}
+			}
+
+			if header.IndexType != AVIIndexOfChunks {
+				continue
+			}
+
+			records, err := r.parseStdIndex(header, chunk.Size)
+			if err != nil {
+				return err
+			}
+			r.odmlIndex = append(r.odmlIndex, records...)
+		}
+	}
+
+	if len(r.odmlIndex) == 0 {
+		return nil
+	}
+
+	// Palette changes have standard indexes of their own, but older
+	// writers only list them in idx1
+	indexed := make(map[int64]bool, len(r.odmlIndex))
+	for _, record := range r.odmlIndex {
+		indexed[record.position] = true
+	}
+	for _, record := range r.index {
+		if _, twoCC, ok := ParseChunkID(record.chunkID); ok && twoCC == "pc" && !indexed[record.position] {
+			r.odmlIndex = append(r.odmlIndex, record)
+		}
+	}
+
+	// Each stream's entries are in file order, interleave them
+	sort.SliceStable(r.odmlIndex, func(i, j int) bool {
+		return r.odmlIndex[i].position < r.odmlIndex[j].position
+	})
+
+	// ix## entries only tell keyframes apart, take the other flags from
+	// idx1 where it covers the same chunk
+	for i, record := range r.odmlIndex {
+		if flags, ok := r.indexFlags(record.position); ok {
+			r.odmlIndex[i].flags = record.flags | flags&^AVIIFKeyframe
+		}
+	}
+	r.index = r.odmlIndex
+	r.indexByPosition = r.index
+	r.odmlIndex = nil
+
 	return nil
 }
 
 // parseSTRHChunk parses a stream header
 func (r *Reader) parseSTRHChunk(size uint32, stream *Stream) error {
-	var header AVIStreamHeader
-	if err := binary.Read(r.r, binary.LittleEndian, &header); err != nil {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
 		return &AVIError{Op: "read strh", Err: err}
 	}
+	if err := r.skipPadding(size); err != nil {
+		return err
+	}
+
+	// Older files end the header before the frame rectangle
+	var header AVIStreamHeader
+	fields := make([]byte, 56) // sizeof(AVIStreamHeader)
+	copy(fields, data)
+	binary.Read(bytes.NewReader(fields), binary.LittleEndian, &header)
 
 	// Determine stream type
 	if IsVideoStream(header.Type) {
@@ -317,47 +670,82 @@ func (r *Reader) parseSTRHChunk(size uint32, stream *Stream) error {
 	} else if IsAudioStream(header.Type) {
 		stream.Type = StreamTypeAudio  
 		stream.Codec.Type = StreamTypeAudio
+	} else if IsTextStream(header.Type) {
+		stream.Type = StreamTypeSubtitle
+		stream.Codec.Type = StreamTypeSubtitle
+	} else if IsDVStream(header.Type) {
+		// Read as video, its audio becomes a stream of its own
+		stream.Type = StreamTypeVideo
+		stream.Codec.Type = StreamTypeVideo
+		r.timing[stream.Index].dvType1 = true
+	} else {
+		// Kept as is to be written back unchanged
+		stream.Type = StreamTypeData
+		stream.Codec.Type = StreamTypeData
+		stream.Codec.RawHeader = data
 	}
 
 	// Set codec handler
 	stream.Codec.FourCC = header.Handler
-	
-	// Clean up codec name (remove null bytes and unprintable characters)
-	codecName := string(header.Handler[:])
-	cleanName := ""
-	for _, b := range []byte(codecName) {
-		if b >= 32 && b <= 126 { // Printable ASCII
-			cleanName += string(b)
-		}
+	stream.Codec.Name = fourCCName(header.Handler)
+
+	stream.SuggestedBufferSize = int(header.SuggestedBufferSize)
+	stream.Flags = header.Flags
+	stream.Priority = header.Priority
+	stream.Language = header.Language
+	stream.InitialFrames = header.InitialFrames
+	stream.Start = header.Start
+	stream.Quality = header.Quality
+	stream.Frame = FrameRect{
+		Left:   int(int16(header.Frame.Left)),
+		Top:    int(int16(header.Frame.Top)),
+		Right:  int(int16(header.Frame.Right)),
+		Bottom: int(int16(header.Frame.Bottom)),
+	}
+	r.timing[stream.Index].sampleSize = header.SampleSize
+
+	// VBR audio stores one frame per chunk and ticks once per frame
+	if stream.Type == StreamTypeAudio && header.SampleSize == 0 && header.Scale > 1 {
+		stream.Codec.VBR = true
+		stream.Codec.SamplesPerFrame = int(header.Scale)
 	}
-	stream.Codec.Name = cleanName
 
 	// Calculate duration and frame rate
 	if header.Rate > 0 && header.Scale > 0 {
+		stream.Codec.TimeBase = Rational{Num: int64(header.Scale), Den: int64(header.Rate)}
 		if stream.Type == StreamTypeVideo {
 			stream.Codec.FPS = float64(header.Rate) / float64(header.Scale)
 		}
 		if header.Length > 0 {
-			stream.Duration = time.Duration(header.Length) * time.Duration(header.Scale) * time.Second / time.Duration(header.Rate)
+			stream.Duration = stream.Codec.TimeBase.Duration(int64(header.Length))
 		}
+		stream.StartTime = stream.Codec.TimeBase.Duration(int64(header.Start))
+		r.timing[stream.Index].start = int64(header.Start)
 	}
 
-	// Skip any remaining bytes
-	if size > 56 { // sizeof(AVIStreamHeader)  
-		if _, err := r.r.Seek(int64(size-56), io.SeekCurrent); err != nil {
-			return &AVIError{Op: "skip strh remainder", Err: err}
-		}
-	}
+	// Initial frames are counted in frames of the file
+	stream.PreRoll = time.Duration(header.InitialFrames) * time.Duration(r.microSecPerFrame) * time.Microsecond
 
 	return nil
 }
 
 // parseSTRFChunk parses stream format chunk
 func (r *Reader) parseSTRFChunk(size uint32, stream *Stream) error {
-	if stream.Type == StreamTypeVideo {
+	if r.timing[stream.Index].dvType1 {
+		return r.parseDVInfo(size, stream)
+	} else if stream.Type == StreamTypeVideo {
 		return r.parseVideoFormat(size, stream)
 	} else if stream.Type == StreamTypeAudio {
 		return r.parseAudioFormat(size, stream)
+	} else if stream.Type == StreamTypeSubtitle || stream.Type == StreamTypeData {
+		// No format structure, whatever is there is kept as is
+		if size > 0 {
+			stream.Codec.ExtraData = make([]byte, size)
+			if _, err := io.ReadFull(r.r, stream.Codec.ExtraData); err != nil {
+				return &AVIError{Op: "read subtitle format", Err: err}
+			}
+		}
+		return r.skipPadding(size)
 	} else {
 		// Skip unknown format
 		if _, err := r.r.Seek(int64(AlignSize(size)), io.SeekCurrent); err != nil {
@@ -376,38 +764,120 @@ func (r *Reader) parseVideoFormat(size uint32, stream *Stream) error {
 
 	stream.Codec.Width = int(bih.Width)
 	stream.Codec.Height = int(bih.Height)
+	stream.Codec.BitCount = int(bih.BitCount)
+	stream.Codec.SizeImage = int(bih.SizeImage)
+	stream.Codec.Uncompressed = bih.Compression == [4]byte{} // BI_RGB
+
+	// Some writers leave the strh handler empty
+	if stream.Codec.FourCC == [4]byte{} && !stream.Codec.Uncompressed {
+		stream.Codec.FourCC = bih.Compression
+		stream.Codec.Name = fourCCName(bih.Compression)
+	}
 	if bih.Height < 0 {
 		stream.Codec.Height = -stream.Codec.Height
 	}
 
-	// Skip remaining bytes
+	// Codec private data follows the header, then the palette of paletted
+	// video
 	if size > 40 { // sizeof(BitmapInfoHeader)
-		if _, err := r.r.Seek(int64(size-40), io.SeekCurrent); err != nil {
-			return &AVIError{Op: "skip bitmap remainder", Err: err}
+		extra := make([]byte, size-40)
+		if _, err := io.ReadFull(r.r, extra); err != nil {
+			return &AVIError{Op: "read bitmap extra data", Err: err}
+		}
+
+		if bih.BitCount > 0 && bih.BitCount <= 8 {
+			colors := int(bih.ClrUsed)
+			if colors == 0 || colors > 1<<bih.BitCount {
+				colors = 1 << bih.BitCount
+			}
+			if colors*4 > len(extra) {
+				colors = len(extra) / 4
+			}
+
+			palette := extra[len(extra)-colors*4:]
+			stream.Codec.Palette = make([]uint32, colors)
+			for i := range stream.Codec.Palette {
+				stream.Codec.Palette[i] = binary.LittleEndian.Uint32(palette[i*4:]) // RGBQUAD
+			}
+			extra = extra[:len(extra)-colors*4]
+		}
+
+		if len(extra) > 0 {
+			stream.Codec.ExtraData = extra
 		}
 	}
 
-	return nil
+	return r.skipPadding(size)
 }
 
 // parseAudioFormat parses audio format info  
 func (r *Reader) parseAudioFormat(size uint32, stream *Stream) error {
-	var wfx WaveFormatEx
-	if err := binary.Read(r.r, binary.LittleEndian, &wfx); err != nil {
+	if size < 16 { // sizeof(WaveFormat)
+		return &AVIError{Op: "read wave format", Err: fmt.Errorf("strf too short (%d bytes)", size)}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
 		return &AVIError{Op: "read wave format", Err: err}
 	}
 
+	// Older files use the 16 byte WAVEFORMAT without cbSize
+	var wfx WaveFormatEx
+	header := make([]byte, 18)
+	copy(header, data)
+	binary.Read(bytes.NewReader(header), binary.LittleEndian, &wfx)
+
 	stream.Codec.Channels = int(wfx.Channels)
 	stream.Codec.SampleRate = int(wfx.SamplesPerSec)
 	stream.Codec.BitDepth = int(wfx.BitsPerSample)
 
-	// Skip remaining bytes
-	if size > 18 { // sizeof(WaveFormatEx) without extra data
-		if _, err := r.r.Seek(int64(size-18), io.SeekCurrent); err != nil {
-			return &AVIError{Op: "skip wave remainder", Err: err}
+	stream.Codec.FormatTag = wfx.FormatTag
+	stream.Codec.BlockAlign = int(wfx.BlockAlign)
+	stream.Codec.AvgBytesPerSec = int(wfx.AvgBytesPerSec)
+
+	// cbSize bytes of codec private data follow the structure
+	if size > 18 && wfx.Size > 0 { // sizeof(WaveFormatEx) without extra data
+		extra := data[18:]
+		if int(wfx.Size) < len(extra) {
+			extra = extra[:wfx.Size]
+		}
+
+		if wfx.FormatTag == WAVEFormatExtensible && len(extra) >= 22 { // sizeof(WaveFormatExtensible)
+			var ext WaveFormatExtensible
+			binary.Read(bytes.NewReader(extra), binary.LittleEndian, &ext)
+			stream.Codec.ValidBitsPerSample = int(ext.ValidBitsPerSample)
+			stream.Codec.ChannelMask = ext.ChannelMask
+			stream.Codec.SubFormat = ext.SubFormat
+			extra = extra[22:]
+		}
+
+		if len(extra) > 0 {
+			stream.Codec.ExtraData = extra
 		}
 	}
 
+	return r.skipPadding(size)
+}
+
+// fourCCName returns the printable characters of a FourCC
+func fourCCName(fourCC [4]byte) string {
+	name := ""
+	for _, b := range fourCC {
+		if b >= 32 && b <= 126 { // Printable ASCII
+			name += string(b)
+		}
+	}
+	return name
+}
+
+// skipPadding skips the pad byte following a chunk of odd size
+func (r *Reader) skipPadding(size uint32) error {
+	if size%2 == 0 {
+		return nil
+	}
+	if _, err := r.r.Seek(1, io.SeekCurrent); err != nil {
+		return &AVIError{Op: "skip padding", Err: err}
+	}
 	return nil
 }
 
@@ -428,14 +898,282 @@ func (r *Reader) GetStreams() ([]Stream, error) {
 }
 
 // ReadPacket reads the next packet from the file
+//
+// Chunks are read in file order straight from the movi list, descending into
+// rec lists and skipping JUNK and index chunks, so files without an idx1 can
+// be read as well. io.EOF is returned at the end of the movi list.
 func (r *Reader) ReadPacket() (*Packet, error) {
-	// This is a simplified implementation
-	// In practice, you'd seek to the movi chunk and read packets sequentially
-	return nil, &AVIError{Op: "read packet", Err: fmt.Errorf("not implemented yet")}
+	if r.r == nil || r.fileInfo == nil {
+		return nil, &AVIError{Op: "read packet", Err: fmt.Errorf("file not opened")}
+	}
+
+	if len(r.segments) == 0 {
+		return nil, &AVIError{Op: "read packet", Err: fmt.Errorf("no movi list found")}
+	}
+
+	if len(r.pending) > 0 {
+		packet := r.pending[0]
+		r.pending = r.pending[1:]
+		return packet, nil
+	}
+
+	for r.segment < len(r.segments) {
+		if r.recovered {
+			// Step over damaged regions using the rebuilt index
+			entry, ok := r.nextIndexed(r.readPos)
+			if !ok {
+				return nil, io.EOF
+			}
+			r.readPos = entry.position
+			for r.segment < len(r.segments)-1 && r.readPos >= r.segments[r.segment].end {
+				r.segment++
+			}
+		}
+
+		if r.readPos+8 > r.segments[r.segment].end {
+			// Continue with the movi list of the next RIFF segment
+			r.segment++
+			if r.segment < len(r.segments) {
+				r.readPos = r.segments[r.segment].start + 4
+			}
+			continue
+		}
+
+		if _, err := r.r.Seek(r.readPos, io.SeekStart); err != nil {
+			return nil, &AVIError{Op: "seek to packet", Err: err}
+		}
+
+		var header ChunkHeader
+		if err := binary.Read(r.r, binary.LittleEndian, &header); err != nil {
+			return nil, &AVIError{Op: "read packet header", Err: err}
+		}
+
+		position := r.readPos
+		next := position + 8 + int64(AlignSize(header.Size))
+
+		if id := ChunkIDToString(header.ID); id == LISTSignature || id == RIFFSignature {
+			var listType [4]byte
+			if err := binary.Read(r.r, binary.LittleEndian, &listType); err != nil {
+				return nil, &AVIError{Op: "read list type", Err: err}
+			}
+			switch string(listType[:]) {
+			case RECList, MOVIList, AVIXSignature:
+				// Step into the list, its chunks follow the list type. movi
+				// and AVIX only show up here when a segment size was never
+				// patched by the writer.
+				r.readPos = position + 12
+			default:
+				r.readPos = next
+			}
+			continue
+		}
+
+		streamIndex, twoCC, ok := ParseChunkID(header.ID)
+		if ok && r.isPaletteChunk(streamIndex, twoCC) {
+			// Held back for the stream's next frame
+			change, valid, err := r.readPaletteChange(position, header.Size)
+			if err != nil {
+				return nil, err
+			}
+			if valid {
+				r.palettes[streamIndex] = append(r.palettes[streamIndex], change)
+			}
+			r.readPos = next
+			continue
+		}
+
+		codecType, known := r.chunkStreamType(streamIndex, twoCC)
+		if !ok || !known {
+			// JUNK, ix## and anything else that is not stream data
+			r.readPos = next
+			continue
+		}
+
+		// Without an index entry there is nothing better to go on than
+		// treating the chunk as a keyframe
+		flags, indexed := r.indexFlags(position)
+		if !indexed {
+			flags = AVIIFKeyframe
+		}
+
+		if r.timing[streamIndex].dvType1 {
+			packets, err := r.readDVChunk(streamIndex, header.Size, position, flags)
+			if err != nil {
+				return nil, err
+			}
+			r.readPos = next
+			if next > r.fileSize {
+				r.readPos = r.fileSize
+			}
+			if len(packets) == 0 {
+				continue
+			}
+			r.pending = packets[1:]
+			return packets[0], nil
+		}
+
+		skip := r.clocks[streamIndex].packets < r.skipUntil[streamIndex]
+		discard := r.clocks[streamIndex].packets < r.discardUntil[streamIndex]
+		packet := r.newPacket(r.clocks, streamIndex, codecType, header.Size, position, flags)
+		if skip {
+			// Before this stream's seek target
+			r.readPos = next
+			continue
+		}
+		if discard {
+			// Only needed to decode the frame sought to
+			packet.Flags |= PacketDiscard
+		}
+
+		// A chunk cut off by the end of the file is returned with what is
+		// left of its data and marked as corrupt
+		size := int64(header.Size)
+		if position+8+size > r.fileSize {
+			size = r.fileSize - position - 8
+			packet.Size = int(size)
+			packet.Flags |= PacketCorrupt
+			next = r.fileSize
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return nil, &AVIError{Op: "read packet data", Err: err}
+		}
+		r.readPos = next
+
+		packet.Data = data
+		if codecType == StreamTypeData {
+			packet.ChunkType = twoCC
+		}
+		if codecType == StreamTypeVideo {
+			packet.PaletteChanges = r.palettes[streamIndex]
+			r.palettes[streamIndex] = nil
+		}
+		return &packet, nil
+	}
+
+	return nil, io.EOF
+}
+
+// indexFlags returns the index flags of the chunk whose header starts at
+// position
+func (r *Reader) indexFlags(position int64) (uint32, bool) {
+	i := sort.Search(len(r.indexByPosition), func(i int) bool {
+		return r.indexByPosition[i].position >= position
+	})
+	if i < len(r.indexByPosition) && r.indexByPosition[i].position == position {
+		return r.indexByPosition[i].flags, true
+	}
+	return 0, false
+}
+
+// sortIndexByPosition sets the index flag lookups up. Some writers store
+// idx1 entries out of file order, those are looked up in a sorted copy so
+// that the index keeps its playback order.
+func (r *Reader) sortIndexByPosition() {
+	byPosition := func(index []indexRecord) func(i, j int) bool {
+		return func(i, j int) bool { return index[i].position < index[j].position }
+	}
+
+	r.indexByPosition = r.index
+	if sort.SliceIsSorted(r.index, byPosition(r.index)) {
+		return
+	}
+	r.indexByPosition = append([]indexRecord(nil), r.index...)
+	sort.SliceStable(r.indexByPosition, byPosition(r.indexByPosition))
+}
+
+// isPaletteChunk reports whether a movi chunk is a palette change of a
+// video stream
+func (r *Reader) isPaletteChunk(streamIndex int, twoCC string) bool {
+	return twoCC == "pc" && streamIndex < len(r.streams) && r.streams[streamIndex].Type == StreamTypeVideo
+}
+
+// readPaletteChange reads the ##pc chunk whose header starts at position.
+// It reports false for a chunk too short to hold a palette change.
+func (r *Reader) readPaletteChange(position int64, size uint32) (PaletteChange, bool, error) {
+	if available := r.fileSize - position - 8; int64(size) > available {
+		if available < 0 {
+			return PaletteChange{}, false, nil
+		}
+		size = uint32(available)
+	}
+
+	if _, err := r.r.Seek(position+8, io.SeekStart); err != nil {
+		return PaletteChange{}, false, &AVIError{Op: "seek to palette change", Err: err}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return PaletteChange{}, false, &AVIError{Op: "read palette change", Err: err}
+	}
+
+	change, ok := parsePaletteChange(data)
+	return change, ok, nil
+}
+
+// parsePaletteChange decodes an AVIPALCHANGE structure: first entry, entry
+// count (0 for 256), flags and the PALETTEENTRY values
+func parsePaletteChange(data []byte) (PaletteChange, bool) {
+	if len(data) < 4 {
+		return PaletteChange{}, false
+	}
+
+	count := int(data[1])
+	if count == 0 {
+		count = 256
+	}
+	if available := (len(data) - 4) / 4; count > available {
+		count = available
+	}
+
+	change := PaletteChange{FirstEntry: int(data[0]), Entries: make([]uint32, count)}
+	for i := range change.Entries {
+		entry := data[4+i*4:]
+		change.Entries[i] = uint32(entry[3])<<24 | uint32(entry[0])<<16 | uint32(entry[1])<<8 | uint32(entry[2])
+	}
+	return change, true
+}
+
+// chunkStreamType maps the type code of a stream's movi chunk to the kind of
+// stream it carries. Data streams own their chunks whatever the type code.
+func (r *Reader) chunkStreamType(streamIndex int, twoCC string) (StreamType, bool) {
+	if streamIndex >= len(r.streams) {
+		return "", false
+	}
+	if r.streams[streamIndex].Type == StreamTypeData {
+		return StreamTypeData, true
+	}
+
+	switch twoCC {
+	case "dc", "db": // video chunks
+		return StreamTypeVideo, true
+	case "wb": // audio chunks
+		return StreamTypeAudio, true
+	case "tx": // subtitle chunks
+		return StreamTypeSubtitle, true
+	case "__": // DV type-1 frames, split into video and audio
+		return StreamTypeVideo, true
+	}
+	return "", false
+}
+
+// resetPlayback rewinds ReadPacket to the start of the movi data
+func (r *Reader) resetPlayback() {
+	r.clocks = make([]streamClock, len(r.streams))
+	r.skipUntil = make([]int64, len(r.streams))
+	r.discardUntil = make([]int64, len(r.streams))
+	r.palettes = make([][]PaletteChange, len(r.streams))
+	r.pending = nil
+	r.seekIndex = nil
+	r.segment = 0
+	if len(r.segments) > 0 {
+		r.readPos = r.segments[0].start + 4
+	}
 }
 
 // ReadPacketData reads the actual data for a packet at the given position
-func (r *Reader) ReadPacketData(packet *Packet) ([]byte, error) {
+func (r *Reader) ReadPacketData(packet *Packet) (data []byte, err error) {
 	if r.r == nil {
 		return nil, &AVIError{Op: "read packet data", Err: fmt.Errorf("file not open")}
 	}
@@ -446,6 +1184,13 @@ func (r *Reader) ReadPacketData(packet *Packet) ([]byte, error) {
 		return nil, &AVIError{Op: "get current position", Err: err}
 	}
 
+	// Restore position on every return, failed reads included
+	defer func() {
+		if _, seekErr := r.r.Seek(currentPos, io.SeekStart); seekErr != nil && err == nil {
+			data, err = nil, &AVIError{Op: "restore position", Err: seekErr}
+		}
+	}()
+
 	// Seek to packet position (which points to chunk header)
 	if _, err := r.r.Seek(packet.Position, io.SeekStart); err != nil {
 		return nil, &AVIError{Op: "seek to packet", Err: err}
@@ -467,156 +1212,370 @@ func (r *Reader) ReadPacketData(packet *Packet) ([]byte, error) {
 		return nil, &AVIError{Op: "get position after header", Err: err}
 	}
 	
-	// Debug: check if we're trying to read beyond file bounds
-	if currentPosAfterHeader + int64(dataSize) > r.fileSize {
+	// Chunks cut off by the end of the file only have what is left of them
+	if currentPosAfterHeader + int64(dataSize) > r.fileSize && packet.Flags&PacketCorrupt != 0 && currentPosAfterHeader <= r.fileSize {
+		dataSize = uint32(r.fileSize - currentPosAfterHeader)
+	} else if currentPosAfterHeader + int64(dataSize) > r.fileSize {
 		return nil, &AVIError{Op: "read packet data", Err: fmt.Errorf("packet would read beyond file bounds: pos=%d, size=%d, filesize=%d", currentPosAfterHeader, dataSize, r.fileSize)}
 	}
 	
 	// Read packet data
-	data := make([]byte, dataSize)
+	data = make([]byte, dataSize)
 	if _, err := io.ReadFull(r.r, data); err != nil {
 		return nil, &AVIError{Op: "read packet data", Err: err}
 	}
 
-	// Restore position
-	if _, err := r.r.Seek(currentPos, io.SeekStart); err != nil {
-		return nil, &AVIError{Op: "restore position", Err: err}
+	// Audio split from a DV type-1 chunk is decoded from the frame
+	if _, ok := r.dvSource(packet.StreamIndex); ok {
+		if data, err = readDVAudio(data); err != nil {
+			return nil, err
+		}
 	}
 
 	return data, nil
 }
 
 // Seek seeks to a specific timestamp
+//
+// The next ReadPacket returns the last video keyframe at or before timestamp,
+// see SeekWithMode for the other modes.
 func (r *Reader) Seek(timestamp time.Duration) error {
-	// This would require index parsing
-	return &AVIError{Op: "seek", Err: fmt.Errorf("not implemented yet")}
+	return r.SeekWithMode(timestamp, SeekPreviousKeyframe)
+}
+
+// SeekWithMode positions the next ReadPacket on the video frame selected by
+// mode. Every other stream resumes with the packet playing at that frame's
+// time, so audio stays aligned with the video it accompanies. Files without
+// video seek on their first stream instead.
+//
+// With SeekExact, ReadPacket starts at the keyframe the selected frame
+// depends on and marks the frames before it PacketDiscard.
+func (r *Reader) SeekWithMode(timestamp time.Duration, mode SeekMode) error {
+	if r.r == nil || r.fileInfo == nil {
+		return &AVIError{Op: "seek", Err: fmt.Errorf("file not opened")}
+	}
+
+	if r.seekIndex == nil {
+		packets, err := r.ReadAllPackets()
+		if err != nil {
+			return &AVIError{Op: "seek", Err: err}
+		}
+		r.seekIndex = packets
+	}
+
+	reference := 0
+	for _, stream := range r.streams {
+		if stream.Type == StreamTypeVideo {
+			reference = stream.Index
+			break
+		}
+	}
+
+	// Pick the target packet of the reference stream
+	target := -1
+	for i, packet := range r.seekIndex {
+		if packet.StreamIndex != reference {
+			continue
+		}
+		if mode != SeekExact && packet.Flags&PacketKeyframe == 0 {
+			continue
+		}
+
+		switch {
+		case target < 0:
+			target = i
+		case mode == SeekNearestKeyframe:
+			if absDuration(packet.PTSTime-timestamp) < absDuration(r.seekIndex[target].PTSTime-timestamp) {
+				target = i
+			}
+		case packet.PTSTime <= timestamp:
+			target = i
+		}
+	}
+
+	if target < 0 {
+		return &AVIError{Op: "seek", Err: fmt.Errorf("no seekable packets in stream %d", reference)}
+	}
+	seekTime := r.seekIndex[target].PTSTime
+
+	// An exact seek decodes from the keyframe before the target
+	start := target
+	if mode == SeekExact {
+		for i := target; i >= 0; i-- {
+			packet := r.seekIndex[i]
+			if packet.StreamIndex != reference {
+				continue
+			}
+			start = i
+			if packet.Flags&PacketKeyframe != 0 {
+				break
+			}
+		}
+	}
+
+	// Resume every other stream at the packet playing at seekTime
+	resume := make([]int, len(r.streams))
+	for i := range resume {
+		resume[i] = -1
+	}
+	resume[reference] = start
+	for i, packet := range r.seekIndex {
+		if resume[packet.StreamIndex] < 0 && packet.PTSTime+packet.DurationTime > seekTime {
+			resume[packet.StreamIndex] = i
+		}
+	}
+
+	readPos := r.seekIndex[target].Position
+	for _, i := range resume {
+		if i >= 0 && r.seekIndex[i].Position < readPos {
+			readPos = r.seekIndex[i].Position
+		}
+	}
+
+	// Rebuild the per stream packet counts at readPos, streams that ended
+	// before seekTime are skipped entirely
+	for i := range r.clocks {
+		r.clocks[i] = streamClock{}
+		r.skipUntil[i] = 0
+		r.discardUntil[i] = 0
+	}
+	for i, packet := range r.seekIndex {
+		if packet.Position < readPos {
+			r.clocks[packet.StreamIndex].packets++
+			r.clocks[packet.StreamIndex].bytes += int64(packet.Size)
+		}
+		if resume[packet.StreamIndex] < 0 || i < resume[packet.StreamIndex] {
+			r.skipUntil[packet.StreamIndex]++
+		}
+		if packet.StreamIndex == reference && i < target {
+			r.discardUntil[packet.StreamIndex]++
+		}
+	}
+
+	r.pending = nil
+
+	// Palette changes before readPos all apply to the next frame read
+	for i := range r.palettes {
+		r.palettes[i] = nil
+	}
+	for _, entry := range r.index {
+		streamIndex, twoCC, ok := ParseChunkID(entry.chunkID)
+		if entry.position >= readPos || !ok || !r.isPaletteChunk(streamIndex, twoCC) {
+			continue
+		}
+		change, valid, err := r.readPaletteChange(entry.position, entry.size)
+		if err != nil {
+			return err
+		}
+		if valid {
+			r.palettes[streamIndex] = append(r.palettes[streamIndex], change)
+		}
+	}
+
+	r.readPos = readPos
+	r.segment = 0
+	for r.segment < len(r.segments)-1 && readPos >= r.segments[r.segment].end {
+		r.segment++
+	}
+	return nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
 }
 
 // parseIDX1Chunk parses the index chunk
 func (r *Reader) parseIDX1Chunk(size uint32) error {
 	numEntries := size / 16 // sizeof(IndexEntry)
-	r.indexEntries = make([]IndexEntry, numEntries)
+	r.index = make([]indexRecord, numEntries)
 	
 	for i := uint32(0); i < numEntries; i++ {
-		if err := binary.Read(r.r, binary.LittleEndian, &r.indexEntries[i]); err != nil {
+		var entry IndexEntry
+		if err := binary.Read(r.r, binary.LittleEndian, &entry); err != nil {
 			return &AVIError{Op: "read index entry", Err: err}
 		}
+		r.index[i] = indexRecord{
+			chunkID:  entry.ChunkID,
+			flags:    entry.Flags,
+			position: r.moviOffset + int64(entry.Offset),
+			size:     entry.Size,
+		}
 	}
+	r.sortIndexByPosition()
 	
 	return nil
 }
 
 // ReadAllPackets reads all packets from the file
 func (r *Reader) ReadAllPackets() ([]Packet, error) {
-	if len(r.indexEntries) == 0 {
+	if len(r.index) == 0 {
 		return nil, &AVIError{Op: "read packets", Err: fmt.Errorf("no index entries found")}
 	}
 	
 	var packets []Packet
+	clocks := make([]streamClock, len(r.streams))
+	palettes := make([][]PaletteChange, len(r.streams))
 	
-	for _, entry := range r.indexEntries {
-		// Parse stream index and type from chunk ID
-		chunkID := ChunkIDToString(entry.ChunkID)
-		if len(chunkID) < 4 {
+	for _, entry := range r.index {
+		streamIndex, twoCC, ok := ParseChunkID(entry.chunkID)
+		if !ok || streamIndex >= len(r.streams) {
 			continue
 		}
-		
-		// Extract stream index (first 2 digits)
-		streamIndex := int((chunkID[0]-'0')*10 + (chunkID[1]-'0'))
-		if streamIndex >= len(r.streams) {
+
+		if r.isPaletteChunk(streamIndex, twoCC) {
+			change, valid, err := r.readPaletteChange(entry.position, entry.size)
+			if err != nil {
+				return nil, err
+			}
+			if valid {
+				palettes[streamIndex] = append(palettes[streamIndex], change)
+			}
 			continue
 		}
 		
-		// Extract chunk type (last 2 chars)
-		chunkType := chunkID[2:4]
-		
-		// Determine codec type
-		var codecType StreamType
-		switch chunkType {
-		case "dc", "db": // video chunks
-			codecType = StreamTypeVideo
-		case "wb": // audio chunks
-			codecType = StreamTypeAudio
-		default:
+		codecType, known := r.chunkStreamType(streamIndex, twoCC)
+		if !known {
 			continue
 		}
 		
-		// Calculate timestamp based on stream type and properties
-		var pts, dts int64
-		var ptsTime, dtsTime, durationTime time.Duration
-		
-		if codecType == StreamTypeVideo {
-			// Count video frames for this stream
-			videoFrameCount := int64(0)
-			for _, p := range packets {
-				if p.StreamIndex == streamIndex && p.Codec == StreamTypeVideo {
-					videoFrameCount++
-				}
-			}
-			dts = videoFrameCount
-			pts = dts
-			
-			if r.streams[streamIndex].Codec.FPS > 0 {
-				frameDuration := time.Second / time.Duration(r.streams[streamIndex].Codec.FPS)
-				dtsTime = time.Duration(dts) * frameDuration
-				ptsTime = dtsTime
-				durationTime = frameDuration
-			}
-		} else if codecType == StreamTypeAudio {
-			// Count audio packets for this stream
-			audioPacketCount := int64(0)
-			for _, p := range packets {
-				if p.StreamIndex == streamIndex && p.Codec == StreamTypeAudio {
-					audioPacketCount++
-				}
-			}
-			// Each audio packet is typically 1024 samples
-			samplesPerPacket := int64(1024)
-			dts = audioPacketCount * samplesPerPacket
-			pts = dts // For AVI, PTS equals DTS for audio
-			
-			if r.streams[streamIndex].Codec.SampleRate > 0 {
-				sampleDuration := time.Second / time.Duration(r.streams[streamIndex].Codec.SampleRate)
-				dtsTime = time.Duration(dts) * sampleDuration
-				ptsTime = dtsTime
-				durationTime = time.Duration(samplesPerPacket) * sampleDuration
-			}
+		packet := r.newPacket(clocks, streamIndex, codecType, entry.size, entry.position, entry.flags)
+		if codecType == StreamTypeData {
+			packet.ChunkType = twoCC
 		}
-		
-		// Determine flags
-		flags := "___"
-		if entry.Flags&0x10 != 0 { // AVIIF_KEYFRAME
-			flags = "K__"
+		if available := r.fileSize - entry.position - 8; int64(entry.size) > available && available >= 0 {
+			// Cut off by the end of the file, as returned by ReadPacket
+			packet.Size = int(available)
+			packet.Flags |= PacketCorrupt
 		}
-		
-		position := int64(entry.Offset) + r.moviOffset // Remove +4 since moviOffset now points to correct position
-		
-		
-		packet := Packet{
-			StreamIndex:  streamIndex,
-			Codec:        codecType,
-			Data:         nil, // We don't read actual data for metadata
-			PTS:          pts,
-			DTS:          dts,
-			Duration:     1024, // Default for audio, 1 for video
-			Size:         int(entry.Size),
-			Position:     position,
-			Flags:        flags,
-			PTSTime:      ptsTime,
-			DTSTime:      dtsTime,
-			DurationTime: durationTime,
-		}
-		
 		if codecType == StreamTypeVideo {
-			packet.Duration = 1
+			packet.PaletteChanges = palettes[streamIndex]
+			palettes[streamIndex] = nil
 		}
-		
 		packets = append(packets, packet)
+
+		if r.timing[streamIndex].dvType1 {
+			size, ok, err := r.dvAudioSize(entry.position, entry.size)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				packets = append(packets, r.newPacket(clocks, r.timing[streamIndex].dvAudio, StreamTypeAudio, uint32(size), entry.position, AVIIFKeyframe))
+			}
+		}
 	}
 	
 	return packets, nil
 }
 
+// newPacket builds the metadata of a packet and advances the stream's clock,
+// from which timestamps are derived
+func (r *Reader) newPacket(clocks []streamClock, streamIndex int, codecType StreamType, size uint32, position int64, indexFlags uint32) Packet {
+	// Calculate timestamp based on stream type and properties
+	var pts, dts, duration int64
+	var ptsTime, dtsTime, durationTime time.Duration
+	clock := &clocks[streamIndex]
+	
+	if codecType == StreamTypeVideo {
+		dts = clock.packets
+		pts = dts
+		duration = 1
+		
+		timeBase := r.streams[streamIndex].Codec.TimeBase
+		if !timeBase.Valid() {
+			timeBase = FrameRateTimeBase(r.streams[streamIndex].Codec.FPS)
+		}
+		dtsTime = timeBase.Duration(dts)
+		ptsTime = dtsTime
+		durationTime = timeBase.Duration(dts+1) - dtsTime
+	} else if codecType == StreamTypeAudio {
+		dts, duration, dtsTime, durationTime = r.audioTiming(streamIndex, *clock, size)
+		pts = dts // For AVI, PTS equals DTS for audio
+		ptsTime = dtsTime
+	} else if codecType == StreamTypeSubtitle || codecType == StreamTypeData {
+		// One tick per chunk, GAB2 streams hold the whole subtitle file in
+		// a single chunk timed from the start
+		dts = clock.packets
+		pts = dts
+		duration = 1
+
+		timeBase := r.streams[streamIndex].Codec.TimeBase
+		dtsTime = timeBase.Duration(dts)
+		ptsTime = dtsTime
+		durationTime = timeBase.Duration(dts+1) - dtsTime
+	}
+	clock.packets++
+	clock.bytes += int64(size)
+
+	// Streams starting after the others are offset by their strh Start
+	if start := r.timing[streamIndex].start; start != 0 {
+		pts += start
+		dts += start
+		ptsTime += r.streams[streamIndex].StartTime
+		dtsTime += r.streams[streamIndex].StartTime
+	}
+	
+	packet := Packet{
+		StreamIndex:  streamIndex,
+		Codec:        codecType,
+		Data:         nil, // We don't read actual data for metadata
+		PTS:          pts,
+		DTS:          dts,
+		Duration:     duration,
+		Size:         int(size),
+		Position:     position,
+		Flags:        packetFlags(indexFlags),
+		PTSTime:      ptsTime,
+		DTSTime:      dtsTime,
+		DurationTime: durationTime,
+	}
+	
+	return packet
+}
+
+// audioTiming returns the timestamp and duration of an audio chunk, in strh
+// ticks and as time, from what was read of the stream before it
+func (r *Reader) audioTiming(streamIndex int, clock streamClock, size uint32) (int64, int64, time.Duration, time.Duration) {
+	timing := r.timing[streamIndex]
+	codec := r.streams[streamIndex].Codec
+	timeBase := codec.TimeBase
+
+	switch {
+	case codec.VBR && timeBase.Valid():
+		// One frame per chunk
+		return clock.packets, 1, timeBase.Duration(clock.packets), timeBase.Duration(1)
+	case timing.sampleSize > 0 && timeBase.Valid():
+		// Fixed size samples, PCM and most CBR codecs
+		dts := clock.bytes / int64(timing.sampleSize)
+		duration := int64(size) / int64(timing.sampleSize)
+		return dts, duration, timeBase.Duration(dts), timeBase.Duration(dts+duration) - timeBase.Duration(dts)
+	case codec.AvgBytesPerSec > 0:
+		// No sample size in strh, go by the format's byte rate
+		byteRate := Rational{Num: 1, Den: int64(codec.AvgBytesPerSec)}
+		start := byteRate.Duration(clock.bytes)
+		end := byteRate.Duration(clock.bytes + int64(size))
+		if !timeBase.Valid() {
+			return clock.bytes, int64(size), start, end - start
+		}
+		dts := bytesToTicks(clock.bytes, codec.AvgBytesPerSec, timeBase)
+		return dts, bytesToTicks(clock.bytes+int64(size), codec.AvgBytesPerSec, timeBase) - dts, start, end - start
+	case timeBase.Valid():
+		// Nothing to go by but the chunks, count one tick each
+		return clock.packets, 1, timeBase.Duration(clock.packets), timeBase.Duration(1)
+	}
+
+	return clock.packets, 1, 0, 0
+}
+
+// bytesToTicks converts an audio byte count to ticks of the time base using
+// the byte rate
+func bytesToTicks(bytes int64, avgBytesPerSec int, timeBase Rational) int64 {
+	den := int64(avgBytesPerSec) * timeBase.Num
+	return bytes/den*timeBase.Den + bytes%den*timeBase.Den/den
+}
+
 // Close closes the file
 func (r *Reader) Close() error {
 	if r.r != nil {
@@ -1,7 +1,11 @@
 package avi
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"testing"
+	"time"
 )
 
 func TestNewDemuxer(t *testing.T) {
@@ -193,4 +197,614 @@ func TestAlignSize(t *testing.T) {
 			t.Errorf("AlignSize(%d) = %d, expected %d", test.input, result, test.expected)
 		}
 	}
-}
\ No newline at end of file
+}
+// buildTestAVI muxes frames video packets and, after each, one audio packet
+// into memory and returns the resulting file
+func buildTestAVI(t *testing.T, frames int) []byte {
+	t.Helper()
+
+	buffer := NewSeekableBuffer()
+	muxer := NewMuxer()
+	if err := muxer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create muxer: %v", err)
+	}
+
+	videoIndex, err := muxer.AddStream(Codec{
+		Name:   "MJPG",
+		FourCC: [4]byte{'M', 'J', 'P', 'G'},
+		Type:   StreamTypeVideo,
+		Width:  160,
+		Height: 120,
+		FPS:    25.0,
+	})
+	if err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+
+	audioIndex, err := muxer.AddStream(Codec{
+		Name:       "PCM",
+		Type:       StreamTypeAudio,
+		Channels:   1,
+		SampleRate: 8000,
+		BitDepth:   16,
+	})
+	if err != nil {
+		t.Fatalf("Failed to add audio stream: %v", err)
+	}
+
+	for i := 0; i < frames; i++ {
+		var flags PacketFlags
+		if i%5 == 0 {
+			flags = PacketKeyframe
+		}
+		video := &Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: bytes.Repeat([]byte{byte(i)}, 101+i), Flags: flags}
+		if err := muxer.WritePacket(video); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+
+		audio := &Packet{StreamIndex: audioIndex, Codec: StreamTypeAudio, Data: bytes.Repeat([]byte{byte(i)}, 640), Flags: PacketKeyframe}
+		if err := muxer.WritePacket(audio); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+
+	if err := muxer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	return append([]byte(nil), buffer.Bytes()...)
+}
+
+// stripIndexes drops the trailing idx1 chunk of a file written by the muxer
+// and empties its OpenDML super indexes
+func stripIndexes(data []byte) []byte {
+	idx1 := bytes.LastIndex(data, []byte(IDX1Chunk))
+	return stripSuperIndexes(data[:idx1])
+}
+
+// readAllSequential drains a reader through ReadPacket
+func readAllSequential(t *testing.T, reader *Reader) []*Packet {
+	t.Helper()
+
+	var packets []*Packet
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket failed after %d packets: %v", len(packets), err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func TestReadPacketSequential(t *testing.T) {
+	data := buildTestAVI(t, 10)
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 20 {
+		t.Fatalf("Expected 20 packets, got %d", len(packets))
+	}
+
+	indexed, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+
+	for i, packet := range packets {
+		if packet.Position != indexed[i].Position || packet.StreamIndex != indexed[i].StreamIndex {
+			t.Errorf("Packet %d: sequential read at %d/stream %d, index says %d/stream %d",
+				i, packet.Position, packet.StreamIndex, indexed[i].Position, indexed[i].StreamIndex)
+		}
+		if packet.Flags != indexed[i].Flags || packet.DTS != indexed[i].DTS {
+			t.Errorf("Packet %d: flags/dts %#x/%d, index says %#x/%d", i, packet.Flags, packet.DTS, indexed[i].Flags, indexed[i].DTS)
+		}
+		if len(packet.Data) != packet.Size || packet.Data[0] != byte(i/2) {
+			t.Errorf("Packet %d: unexpected payload (size %d, len %d)", i, packet.Size, len(packet.Data))
+		}
+	}
+
+	if _, err := reader.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last packet, got %v", err)
+	}
+}
+
+func TestReadPacketWithoutIndex(t *testing.T) {
+	data := stripIndexes(buildTestAVI(t, 4))
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 8 {
+		t.Fatalf("Expected 8 packets, got %d", len(packets))
+	}
+
+	for i, packet := range packets {
+		if packet.Flags != PacketKeyframe {
+			t.Errorf("Packet %d: unindexed packets should be reported as keyframes, got %#x", i, packet.Flags)
+		}
+	}
+}
+
+func TestReadPacketUnsortedIndex(t *testing.T) {
+	data := stripSuperIndexes(buildTestAVI(t, 10))
+
+	// Store the idx1 entries in reverse file order
+	idx1 := bytes.LastIndex(data, []byte(IDX1Chunk)) + 8
+	entries := int(binary.LittleEndian.Uint32(data[idx1-4:])) / 16
+	for i, j := 0, entries-1; i < j; i, j = i+1, j-1 {
+		var entry [16]byte
+		copy(entry[:], data[idx1+i*16:])
+		copy(data[idx1+i*16:idx1+i*16+16], data[idx1+j*16:idx1+j*16+16])
+		copy(data[idx1+j*16:], entry[:])
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 20 {
+		t.Fatalf("Expected 20 packets, got %d", len(packets))
+	}
+
+	for i, packet := range packets {
+		keyframe := packet.Codec == StreamTypeAudio || (i/2)%5 == 0
+		if (packet.Flags&PacketKeyframe != 0) != keyframe {
+			t.Errorf("Packet %d: expected keyframe %v, got flags %#x", i, keyframe, packet.Flags)
+		}
+	}
+}
+
+func TestReadPacketTruncatedChunk(t *testing.T) {
+	// Cut the last audio chunk, the ix## chunks follow the movi data
+	full := stripIndexes(buildTestAVI(t, 4))
+	data := full[:bytes.Index(full, []byte("ix00"))-100]
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 8 {
+		t.Fatalf("Expected 8 packets, got %d", len(packets))
+	}
+
+	for i, packet := range packets[:7] {
+		if packet.Flags&PacketCorrupt != 0 {
+			t.Errorf("Packet %d: complete chunk marked as corrupt", i)
+		}
+	}
+
+	last := packets[7]
+	if last.Flags != PacketKeyframe|PacketCorrupt {
+		t.Errorf("Expected the cut off chunk to be flagged corrupt, got %#x", last.Flags)
+	}
+	if last.Size != 540 || len(last.Data) != 540 {
+		t.Errorf("Expected the 540 bytes left of the chunk, got size %d, len %d", last.Size, len(last.Data))
+	}
+}
+
+func TestReadPacketRecListAndJunk(t *testing.T) {
+	data := stripIndexes(buildTestAVI(t, 2))
+
+	// Wrap the first video/audio pair in a rec list and put a JUNK chunk in
+	// front of it, leaving the rest of the movi list untouched
+	movi := bytes.Index(data, []byte(MOVIList))
+	first := movi + 4
+	firstSize := 8 + int(AlignSize(binary.LittleEndian.Uint32(data[first+4:])))
+	second := first + firstSize
+	pairSize := firstSize + 8 + int(AlignSize(binary.LittleEndian.Uint32(data[second+4:])))
+
+	var movie bytes.Buffer
+	movie.Write(WriteChunkHeader(ChunkHeader{ID: StringToChunkID(JUNKChunk), Size: 3}))
+	movie.Write([]byte{0, 0, 0, 0})
+	movie.Write(WriteChunkHeader(ChunkHeader{ID: StringToChunkID(LISTSignature), Size: uint32(4 + pairSize)}))
+	movie.WriteString(RECList)
+	movie.Write(data[first : first+pairSize])
+
+	var rebuilt []byte
+	rebuilt = append(rebuilt, data[:first]...)
+	rebuilt = append(rebuilt, movie.Bytes()...)
+	rebuilt = append(rebuilt, data[first+pairSize:]...)
+
+	// Fix up the movi list size
+	grown := uint32(movie.Len() - pairSize)
+	binary.LittleEndian.PutUint32(rebuilt[movi-4:], binary.LittleEndian.Uint32(rebuilt[movi-4:])+grown)
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(rebuilt), int64(len(rebuilt))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 4 {
+		t.Fatalf("Expected 4 packets, got %d", len(packets))
+	}
+
+	for i, packet := range packets {
+		if packet.StreamIndex != i%2 || packet.Data[0] != byte(i/2) {
+			t.Errorf("Packet %d: got stream %d payload %d", i, packet.StreamIndex, packet.Data[0])
+		}
+	}
+}
+
+func TestParseChunkID(t *testing.T) {
+	tests := []struct {
+		id          string
+		streamIndex int
+		twoCC       string
+		ok          bool
+	}{
+		{"00dc", 0, "dc", true},
+		{"12wb", 12, "wb", true},
+		{"ix00", 0, "", false},
+		{"JUNK", 0, "", false},
+	}
+
+	for _, test := range tests {
+		streamIndex, twoCC, ok := ParseChunkID(StringToChunkID(test.id))
+		if streamIndex != test.streamIndex || twoCC != test.twoCC || ok != test.ok {
+			t.Errorf("ParseChunkID(%q) = %d, %q, %v, expected %d, %q, %v",
+				test.id, streamIndex, twoCC, ok, test.streamIndex, test.twoCC, test.ok)
+		}
+	}
+}
+
+func TestSeekModes(t *testing.T) {
+	data := buildTestAVI(t, 10)
+
+	tests := []struct {
+		name      string
+		timestamp time.Duration
+		mode      SeekMode
+		frame     byte
+	}{
+		{"previous keyframe", 250 * time.Millisecond, SeekPreviousKeyframe, 5},
+		{"previous keyframe before start", -time.Second, SeekPreviousKeyframe, 0},
+		{"nearest keyframe", 90 * time.Millisecond, SeekNearestKeyframe, 0},
+		{"nearest keyframe after", 130 * time.Millisecond, SeekNearestKeyframe, 5},
+		{"exact", 250 * time.Millisecond, SeekExact, 6},
+		{"exact past end", time.Hour, SeekExact, 9},
+	}
+
+	for _, test := range tests {
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+
+		if err := reader.SeekWithMode(test.timestamp, test.mode); err != nil {
+			t.Fatalf("%s: seek failed: %v", test.name, err)
+		}
+
+		// Frames decoded only to reach an exact target are not shown
+		packets := readAllSequential(t, reader)
+		var video, audio *Packet
+		for _, packet := range packets {
+			if packet.Codec == StreamTypeVideo && video == nil && packet.Flags&PacketDiscard == 0 {
+				video = packet
+			}
+			if packet.Codec == StreamTypeAudio && audio == nil {
+				audio = packet
+			}
+		}
+
+		if video == nil || video.Data[0] != test.frame {
+			t.Errorf("%s: expected to resume at video frame %d, got %v", test.name, test.frame, video)
+			continue
+		}
+
+		if video.DTS != int64(test.frame) {
+			t.Errorf("%s: expected DTS %d after seek, got %d", test.name, test.frame, video.DTS)
+		}
+
+		if audio != nil && (audio.PTSTime > video.PTSTime || audio.PTSTime+audio.DurationTime <= video.PTSTime) {
+			t.Errorf("%s: audio resumes at %v+%v, not covering video at %v",
+				test.name, audio.PTSTime, audio.DurationTime, video.PTSTime)
+		}
+	}
+}
+
+func TestSeekExactDiscard(t *testing.T) {
+	data := buildTestAVI(t, 10)
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	// Frame 8 depends on keyframe 5
+	if err := reader.SeekWithMode(320*time.Millisecond, SeekExact); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+
+	var video []*Packet
+	for _, packet := range readAllSequential(t, reader) {
+		if packet.Codec == StreamTypeVideo {
+			video = append(video, packet)
+		}
+	}
+	if len(video) != 5 {
+		t.Fatalf("Expected frames 5 to 9, got %d frames", len(video))
+	}
+
+	if video[0].Data[0] != 5 || video[0].Flags&PacketKeyframe == 0 {
+		t.Errorf("Expected to resume at keyframe 5, got frame %d with flags %#x", video[0].Data[0], video[0].Flags)
+	}
+	for i, packet := range video {
+		discard := packet.Data[0] < 8
+		if (packet.Flags&PacketDiscard != 0) != discard {
+			t.Errorf("Frame %d: expected discard %v, got flags %#x", packet.Data[0], discard, packet.Flags)
+		}
+		if packet.DTS != int64(5+i) {
+			t.Errorf("Frame %d: expected DTS %d, got %d", packet.Data[0], 5+i, packet.DTS)
+		}
+	}
+
+	// Reading on from a keyframe seek marks nothing
+	if err := reader.SeekWithMode(320*time.Millisecond, SeekPreviousKeyframe); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	for _, packet := range readAllSequential(t, reader) {
+		if packet.Flags&PacketDiscard != 0 {
+			t.Errorf("Packet at %v: unexpected discard flag after a keyframe seek", packet.PTSTime)
+		}
+	}
+}
+
+func TestAudioTimestamps(t *testing.T) {
+	data := buildTestAVI(t, 10)
+
+	// Same file without a sample size in the audio strh
+	byteRate := append([]byte(nil), data...)
+	strh := bytes.LastIndex(byteRate, []byte(STRHChunk))
+	binary.LittleEndian.PutUint32(byteRate[strh+8+44:], 0)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"sample size", data},
+		{"byte rate", byteRate},
+	}
+
+	for _, test := range tests {
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(test.data), int64(len(test.data))); err != nil {
+			t.Fatalf("%s: failed to open: %v", test.name, err)
+		}
+
+		packets, err := reader.ReadAllPackets()
+		if err != nil {
+			t.Fatalf("%s: ReadAllPackets failed: %v", test.name, err)
+		}
+
+		// 640 bytes of 8 kHz 16-bit mono PCM are 320 samples, 40ms
+		n := int64(0)
+		for _, packet := range packets {
+			if packet.Codec != StreamTypeAudio {
+				continue
+			}
+			if packet.PTS != n*320 || packet.Duration != 320 {
+				t.Errorf("%s: audio packet %d: expected PTS %d duration 320, got %d duration %d", test.name, n, n*320, packet.PTS, packet.Duration)
+			}
+			if packet.PTSTime != time.Duration(n)*40*time.Millisecond || packet.DurationTime != 40*time.Millisecond {
+				t.Errorf("%s: audio packet %d: got time %v duration %v", test.name, n, packet.PTSTime, packet.DurationTime)
+			}
+			n++
+		}
+
+		// ReadPacket keeps the same clock
+		sequential := readAllSequential(t, reader)
+		for i, packet := range sequential {
+			if packet.PTS != packets[i].PTS || packet.PTSTime != packets[i].PTSTime {
+				t.Errorf("%s: packet %d: ReadPacket PTS %d (%v), ReadAllPackets PTS %d (%v)", test.name, i, packet.PTS, packet.PTSTime, packets[i].PTS, packets[i].PTSTime)
+			}
+		}
+	}
+}
+
+func TestDemuxerEmptyHandler(t *testing.T) {
+	data := buildTestAVI(t, 2)
+
+	// Clear the video strh handler, the strf compression still names the codec
+	strh := bytes.Index(data, []byte(STRHChunk)) + 8
+	copy(data[strh+4:strh+8], []byte{0, 0, 0, 0})
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	streams, _ := reader.GetStreams()
+	if streams[0].Codec.Name != "MJPG" || streams[0].Codec.Uncompressed {
+		t.Errorf("Expected MJPG from the strf compression, got %q (uncompressed %v)", streams[0].Codec.Name, streams[0].Codec.Uncompressed)
+	}
+}
+
+func TestSeekRequiresIndex(t *testing.T) {
+	reader := &Reader{}
+	if err := reader.Seek(0); err == nil {
+		t.Error("Expected error when seeking without opening file")
+	}
+}
+
+// buildOpenDMLAVI builds a two segment OpenDML file with a single 10 fps video
+// stream holding framesPerSegment frames per segment, a keyframe every 3
+// frames, and an idx1 covering the first segment only
+func buildOpenDMLAVI(t *testing.T, framesPerSegment int) []byte {
+	t.Helper()
+
+	var file bytes.Buffer
+	write := func(v interface{}) {
+		if err := binary.Write(&file, binary.LittleEndian, v); err != nil {
+			t.Fatalf("Failed to build test file: %v", err)
+		}
+	}
+	chunk := func(id string, size uint32) {
+		write(ChunkHeader{ID: StringToChunkID(id), Size: size})
+	}
+	list := func(listType string, size uint32) {
+		write(LISTHeader{ChunkHeader: ChunkHeader{ID: StringToChunkID(LISTSignature), Size: size}, Type: StringToChunkID(listType)})
+	}
+
+	const indxSize = 24 + 2*16
+	strlSize := uint32(4 + 8 + 56 + 8 + 40 + 8 + indxSize)
+	hdrlSize := 4 + 8 + 56 + 8 + strlSize + 8 + 4 + 8 + 248
+
+	write(RIFFHeader{Signature: StringToChunkID(RIFFSignature), Type: StringToChunkID(AVISignature)})
+	list(HDRLList, hdrlSize)
+	chunk(AVIHChunk, 56)
+	write(AVIMainHeader{MicroSecPerFrame: 100000, TotalFrames: uint32(framesPerSegment), Streams: 1, Width: 64, Height: 48})
+	list(STRLList, strlSize)
+	chunk(STRHChunk, 56)
+	write(AVIStreamHeader{Type: StringToChunkID(STREAMTypeVideo), Handler: StringToChunkID(CODECMjpeg), Scale: 1, Rate: 10, Length: uint32(2 * framesPerSegment)})
+	chunk(STRFChunk, 40)
+	write(BitmapInfoHeader{Size: 40, Width: 64, Height: 48, Planes: 1, BitCount: 24, Compression: StringToChunkID(CODECMjpeg)})
+	chunk(INDXChunk, indxSize)
+	write(AVIMetaIndex{LongsPerEntry: 4, IndexType: AVIIndexOfIndexes, EntriesInUse: 2, ChunkID: StringToChunkID("00dc")})
+	write([3]uint32{})
+	superIndexPos := file.Len()
+	write([2]AVISuperIndexEntry{})
+	list(ODMLList, 4+8+248)
+	chunk(DMLHChunk, 248)
+	write(uint32(2 * framesPerSegment))
+	write([61]uint32{})
+
+	var superIndex [2]AVISuperIndexEntry
+	var idx1 []IndexEntry
+	moviStart := 0
+	frame := 0
+	for segment := 0; segment < 2; segment++ {
+		riffPos := file.Len()
+		if segment > 0 {
+			write(RIFFHeader{Signature: StringToChunkID(RIFFSignature), Type: StringToChunkID(AVIXSignature)})
+		}
+
+		moviPos := file.Len() + 8
+		list(MOVIList, 0)
+		if segment == 0 {
+			moviStart = moviPos
+		}
+
+		var entries []AVIStdIndexEntry
+		for i := 0; i < framesPerSegment; i++ {
+			size := uint32(50 + frame)
+			var flags uint32
+			if frame%3 == 0 {
+				flags = AVIIFKeyframe
+			}
+			if segment == 0 {
+				idx1 = append(idx1, IndexEntry{ChunkID: StringToChunkID("00dc"), Flags: flags, Offset: uint32(file.Len() - moviStart), Size: size})
+			}
+			entry := AVIStdIndexEntry{Offset: uint32(file.Len() + 8 - moviPos), Size: size}
+			if flags == 0 {
+				entry.Size |= AVIStdIndexDeltaFrame
+			}
+			entries = append(entries, entry)
+
+			chunk("00dc", size)
+			file.Write(bytes.Repeat([]byte{byte(frame)}, int(AlignSize(size))))
+			frame++
+		}
+
+		// ix00 at the end of the movi list
+		ixSize := uint32(24 + 8*len(entries))
+		superIndex[segment] = AVISuperIndexEntry{Offset: uint64(file.Len()), Size: 8 + ixSize, Duration: uint32(len(entries))}
+		chunk("ix00", ixSize)
+		write(AVIMetaIndex{LongsPerEntry: 2, IndexType: AVIIndexOfChunks, EntriesInUse: uint32(len(entries)), ChunkID: StringToChunkID("00dc")})
+		write(uint64(moviPos))
+		write(uint32(0))
+		write(entries)
+
+		binary.LittleEndian.PutUint32(file.Bytes()[moviPos-4:], uint32(file.Len()-moviPos))
+
+		if segment == 0 {
+			chunk(IDX1Chunk, uint32(16*len(idx1)))
+			write(idx1)
+		}
+		binary.LittleEndian.PutUint32(file.Bytes()[riffPos+4:], uint32(file.Len()-riffPos-8))
+	}
+
+	data := file.Bytes()
+	for i, entry := range superIndex {
+		pos := superIndexPos + 16*i
+		binary.LittleEndian.PutUint64(data[pos:], entry.Offset)
+		binary.LittleEndian.PutUint32(data[pos+8:], entry.Size)
+		binary.LittleEndian.PutUint32(data[pos+12:], entry.Duration)
+	}
+
+	return data
+}
+
+func TestOpenDMLReading(t *testing.T) {
+	data := buildOpenDMLAVI(t, 5)
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.Duration != time.Second {
+		t.Errorf("Expected the dmlh frame count to give a 1s duration, got %v", fileInfo.Duration)
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+
+	if len(packets) != 10 {
+		t.Fatalf("Expected 10 indexed packets across both segments, got %d", len(packets))
+	}
+
+	for i, packet := range packets {
+		payload, err := reader.ReadPacketData(&packet)
+		if err != nil {
+			t.Fatalf("Packet %d: failed to read data: %v", i, err)
+		}
+		if len(payload) != 50+i || payload[0] != byte(i) {
+			t.Errorf("Packet %d: unexpected payload of %d bytes", i, len(payload))
+		}
+
+		keyframe := i%3 == 0
+		if (packet.Flags&PacketKeyframe != 0) != keyframe {
+			t.Errorf("Packet %d: flags %#x, keyframe expected %v", i, packet.Flags, keyframe)
+		}
+	}
+
+	sequential := readAllSequential(t, reader)
+	if len(sequential) != 10 {
+		t.Fatalf("Expected ReadPacket to cross into the AVIX segment, got %d packets", len(sequential))
+	}
+	for i, packet := range sequential {
+		if packet.Position != packets[i].Position || packet.Flags != packets[i].Flags {
+			t.Errorf("Packet %d: sequential read disagrees with the index", i)
+		}
+	}
+
+	// Frame 7 is in the second segment, its keyframe is frame 6
+	if err := reader.Seek(750 * time.Millisecond); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	packet, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket after seek failed: %v", err)
+	}
+	if packet.Data[0] != 6 || packet.DTS != 6 {
+		t.Errorf("Expected to resume at frame 6, got frame %d (dts %d)", packet.Data[0], packet.DTS)
+	}
+}
@@ -0,0 +1,365 @@
+package avi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DV frames are made of DIF sequences of 150 blocks of 80 bytes: a header,
+// subcode and VAUX blocks, then nine audio blocks each followed by fifteen
+// video blocks
+const (
+	dvBlockSize    = 80
+	dvSequenceSize = 150 * dvBlockSize
+
+	// dvAudioPackOffset is the position of the AAUX source pack, in the
+	// fourth audio block of the first sequence past the block ID
+	dvAudioPackOffset = (6+3*16)*dvBlockSize + 3
+
+	dvAudioSourcePack = 0x50 // Pack header of the AAUX source pack
+)
+
+// dvSampleRates are the AAUX sampling frequencies, by SMP code
+var dvSampleRates = [3]int{48000, 44100, 32000}
+
+// dvSystem is the layout of the frames of a DV system
+type dvSystem struct {
+	sequences    int      // DIF sequences per frame
+	height       int      // Lines per frame
+	minSamples   [3]int   // Fewest audio samples per frame, by SMP code
+	audioStride  int      // Distance between consecutive samples of an audio block
+	audioShuffle [][9]int // First sample of each audio block, per sequence
+}
+
+// dvSystem525 is 525/60 (NTSC) DV. The first half of the shuffle rows place
+// left channel samples, the second half right channel ones.
+var dvSystem525 = dvSystem{
+	sequences:   10,
+	height:      480,
+	minSamples:  [3]int{1580, 1452, 1053},
+	audioStride: 90,
+	audioShuffle: [][9]int{
+		{0, 30, 60, 20, 50, 80, 10, 40, 70},
+		{6, 36, 66, 26, 56, 86, 16, 46, 76},
+		{12, 42, 72, 2, 32, 62, 22, 52, 82},
+		{18, 48, 78, 8, 38, 68, 28, 58, 88},
+		{24, 54, 84, 14, 44, 74, 4, 34, 64},
+
+		{1, 31, 61, 21, 51, 81, 11, 41, 71},
+		{7, 37, 67, 27, 57, 87, 17, 47, 77},
+		{13, 43, 73, 3, 33, 63, 23, 53, 83},
+		{19, 49, 79, 9, 39, 69, 29, 59, 89},
+		{25, 55, 85, 15, 45, 75, 5, 35, 65},
+	},
+}
+
+// dvSystem625 is 625/50 (PAL) DV
+var dvSystem625 = dvSystem{
+	sequences:   12,
+	height:      576,
+	minSamples:  [3]int{1896, 1742, 1264},
+	audioStride: 108,
+	audioShuffle: [][9]int{
+		{0, 36, 72, 26, 62, 98, 16, 52, 88},
+		{6, 42, 78, 32, 68, 104, 22, 58, 94},
+		{12, 48, 84, 2, 38, 74, 28, 64, 100},
+		{18, 54, 90, 8, 44, 80, 34, 70, 106},
+		{24, 60, 96, 14, 50, 86, 4, 40, 76},
+		{30, 66, 102, 20, 56, 92, 10, 46, 82},
+
+		{1, 37, 73, 27, 63, 99, 17, 53, 89},
+		{7, 43, 79, 33, 69, 105, 23, 59, 95},
+		{13, 49, 85, 3, 39, 75, 29, 65, 101},
+		{19, 55, 91, 9, 45, 81, 35, 71, 107},
+		{25, 61, 97, 15, 51, 87, 5, 41, 77},
+		{31, 67, 103, 21, 57, 93, 11, 47, 83},
+	},
+}
+
+// dvAudioFrame is the audio of a DV frame as described by its AAUX source
+// pack
+type dvAudioFrame struct {
+	system  *dvSystem
+	samples int  // Stereo samples in the frame
+	quant   byte // 0 for 16-bit linear, 1 for 12-bit nonlinear samples
+}
+
+// parseDVAudioFrame reads the AAUX source pack of a DV frame, of which only
+// the first dvAudioPackOffset+5 bytes are needed. ok is false for frames
+// without audio or with a sampling the decoder does not handle.
+func parseDVAudioFrame(frame []byte) (dvAudioFrame, bool) {
+	if len(frame) < dvAudioPackOffset+5 {
+		return dvAudioFrame{}, false
+	}
+
+	// DSF flag of the header block
+	system := &dvSystem525
+	if frame[3]&0x80 != 0 {
+		system = &dvSystem625
+	}
+
+	pack := frame[dvAudioPackOffset:]
+	freq := pack[4] >> 3 & 0x07
+	quant := pack[4] & 0x07
+	if pack[0] != dvAudioSourcePack || int(freq) >= len(dvSampleRates) || quant > 1 {
+		return dvAudioFrame{}, false
+	}
+
+	return dvAudioFrame{
+		system:  system,
+		samples: system.minSamples[freq] + int(pack[1]&0x3F), // AF_SIZE
+		quant:   quant,
+	}, true
+}
+
+// size returns the size of the frame's audio as 16-bit stereo PCM
+func (a dvAudioFrame) size() int {
+	return a.samples * 4
+}
+
+// extractDVAudio decodes the audio blocks of a DV frame to 16-bit stereo
+// PCM. Of 12-bit four channel recordings only the first pair is kept.
+func extractDVAudio(frame []byte) ([]byte, bool) {
+	audio, ok := parseDVAudioFrame(frame)
+	if !ok || len(frame) < audio.system.sequences*dvSequenceSize {
+		return nil, false
+	}
+
+	system := audio.system
+	pcm := make([]byte, audio.size())
+	put := func(offset int, sample uint16) {
+		if offset*2 < len(pcm) {
+			binary.LittleEndian.PutUint16(pcm[offset*2:], sample)
+		}
+	}
+
+	// In 12-bit mode the second half of the sequences holds the second
+	// channel pair
+	half := system.sequences / 2
+	sequences := system.sequences
+	if audio.quant == 1 {
+		sequences = half
+	}
+
+	for i := 0; i < sequences; i++ {
+		for j := 0; j < 9; j++ {
+			block := frame[i*dvSequenceSize+(6+j*16)*dvBlockSize:][:dvBlockSize]
+
+			if audio.quant == 0 {
+				// Big endian samples, 0x8000 marks an error
+				for d := 8; d < dvBlockSize; d += 2 {
+					sample := binary.BigEndian.Uint16(block[d:])
+					if sample == 0x8000 {
+						sample = 0
+					}
+					put(system.audioShuffle[i][j]+(d-8)/2*system.audioStride, sample)
+				}
+				continue
+			}
+
+			// Left and right 12-bit samples packed in three bytes
+			for d := 8; d+2 < dvBlockSize; d += 3 {
+				left := uint16(block[d])<<4 | uint16(block[d+2])>>4
+				right := uint16(block[d+1])<<4 | uint16(block[d+2])&0x0F
+				put(system.audioShuffle[i][j]+(d-8)/3*system.audioStride, dvAudio12To16(left))
+				put(system.audioShuffle[i+half][j]+(d-8)/3*system.audioStride, dvAudio12To16(right))
+			}
+		}
+	}
+
+	return pcm, true
+}
+
+// dvAudio12To16 expands a 12-bit nonlinear DV sample, 0x800 marking an
+// error
+func dvAudio12To16(sample uint16) uint16 {
+	if sample == 0x800 {
+		return 0
+	}
+	if sample > 0x800 {
+		sample |= 0xF000
+	}
+
+	shift := (sample & 0xF00) >> 8
+	switch {
+	case shift < 0x2 || shift > 0xD:
+		return sample
+	case shift < 0x8:
+		shift--
+		return (sample - 256*shift) << shift
+	default:
+		shift = 0xE - shift
+		return ((sample + 256*shift + 1) << shift) - 1
+	}
+}
+
+// parseDVInfo parses the DVINFO strf of a DV type-1 stream. The raw
+// structure is kept as the codec's extra data.
+func (r *Reader) parseDVInfo(size uint32, stream *Stream) error {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return &AVIError{Op: "read dvinfo", Err: err}
+	}
+
+	var info DVInfo
+	if len(data) >= 32 { // sizeof(DVInfo)
+		for i, field := range []*uint32{&info.AAuxSrc, &info.AAuxCtl, &info.AAuxSrc1, &info.AAuxCtl1, &info.VAuxSrc, &info.VAuxCtl} {
+			*field = binary.LittleEndian.Uint32(data[i*4:])
+		}
+	}
+	r.timing[stream.Index].dvInfo = info
+	stream.Codec.ExtraData = data
+
+	// The 50/60 flag of the VAUX source pack, or failing that the frame rate
+	pal := stream.Codec.FPS > 0 && stream.Codec.FPS < 27.5
+	if info.VAuxSrc != 0 {
+		pal = info.VAuxSrc>>16&0x20 != 0
+	}
+
+	stream.Codec.Width = 720
+	stream.Codec.Height = dvSystem525.height
+	if pal {
+		stream.Codec.Height = dvSystem625.height
+	}
+	if stream.Codec.FourCC == [4]byte{} {
+		stream.Codec.FourCC = [4]byte{'d', 'v', 's', 'd'}
+		stream.Codec.Name = "dvsd"
+	}
+
+	return r.skipPadding(size)
+}
+
+// splitDVStreams adds an audio stream for each DV type-1 stream, which is
+// itself read as the video stream. The audio streams follow the file's own.
+func (r *Reader) splitDVStreams(streams *[]Stream) {
+	count := len(*streams)
+	for i := 0; i < count; i++ {
+		if !r.timing[i].dvType1 {
+			continue
+		}
+
+		// SMP code of the AAUX source pack
+		sampleRate := dvSampleRates[0]
+		if freq := r.timing[i].dvInfo.AAuxSrc >> 27 & 0x07; int(freq) < len(dvSampleRates) {
+			sampleRate = dvSampleRates[freq]
+		}
+
+		source := (*streams)[i]
+		audio := Stream{
+			Index: len(*streams),
+			Type:  StreamTypeAudio,
+			Codec: Codec{
+				Name:           "PCM",
+				Type:           StreamTypeAudio,
+				TimeBase:       Rational{Num: 1, Den: int64(sampleRate)},
+				Channels:       2,
+				SampleRate:     sampleRate,
+				BitDepth:       16,
+				FormatTag:      WAVEFormatPCM,
+				BlockAlign:     4,
+				AvgBytesPerSec: sampleRate * 4,
+			},
+			Duration:  source.Duration,
+			StartTime: source.StartTime,
+		}
+		audio.Language = source.Language
+
+		r.timing[i].dvAudio = audio.Index
+		r.timing = append(r.timing, streamTiming{sampleSize: 4, start: audio.Codec.TimeBase.Ticks(source.StartTime)})
+		r.superIndexes = append(r.superIndexes, nil)
+		*streams = append(*streams, audio)
+	}
+}
+
+// dvSource returns the DV type-1 stream an audio stream was split from
+func (r *Reader) dvSource(streamIndex int) (int, bool) {
+	for i, timing := range r.timing {
+		if timing.dvType1 && timing.dvAudio == streamIndex {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// dvAudioSize returns the size of the PCM decoded from the DV type-1 chunk
+// whose header starts at position, reading only its AAUX source pack. ok is
+// false when no audio can be decoded from the chunk.
+func (r *Reader) dvAudioSize(position int64, size uint32) (int, bool, error) {
+	if position+8+int64(size) > r.fileSize || size < dvAudioPackOffset+5 {
+		return 0, false, nil
+	}
+
+	if _, err := r.r.Seek(position+8, io.SeekStart); err != nil {
+		return 0, false, &AVIError{Op: "seek to dv frame", Err: err}
+	}
+
+	head := make([]byte, dvAudioPackOffset+5)
+	if _, err := io.ReadFull(r.r, head); err != nil {
+		return 0, false, &AVIError{Op: "read dv frame", Err: err}
+	}
+
+	audio, ok := parseDVAudioFrame(head)
+	if !ok || int(size) < audio.system.sequences*dvSequenceSize {
+		return 0, false, nil
+	}
+	return audio.size(), true, nil
+}
+
+// readDVChunk splits the DV type-1 chunk whose header starts at position
+// into a video packet holding the whole DIF frame and an audio packet of the
+// PCM decoded from it. Packets before their stream's seek target are left
+// out.
+func (r *Reader) readDVChunk(streamIndex int, size uint32, position int64, flags uint32) ([]*Packet, error) {
+	audioIndex := r.timing[streamIndex].dvAudio
+
+	skipVideo := r.clocks[streamIndex].packets < r.skipUntil[streamIndex]
+	discardVideo := r.clocks[streamIndex].packets < r.discardUntil[streamIndex]
+	video := r.newPacket(r.clocks, streamIndex, StreamTypeVideo, size, position, flags)
+	if discardVideo {
+		video.Flags |= PacketDiscard
+	}
+
+	// A frame cut off by the end of the file keeps what is left of it, with
+	// no audio
+	length := int64(size)
+	if position+8+length > r.fileSize {
+		length = r.fileSize - position - 8
+		video.Size = int(length)
+		video.Flags |= PacketCorrupt
+	}
+
+	if _, err := r.r.Seek(position+8, io.SeekStart); err != nil {
+		return nil, &AVIError{Op: "seek to dv frame", Err: err}
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		return nil, &AVIError{Op: "read dv frame", Err: err}
+	}
+	video.Data = frame
+
+	var packets []*Packet
+	if !skipVideo {
+		packets = append(packets, &video)
+	}
+
+	if pcm, ok := extractDVAudio(frame); ok && video.Flags&PacketCorrupt == 0 {
+		skipAudio := r.clocks[audioIndex].packets < r.skipUntil[audioIndex]
+		audio := r.newPacket(r.clocks, audioIndex, StreamTypeAudio, uint32(len(pcm)), position, AVIIFKeyframe)
+		audio.Data = pcm
+		if !skipAudio {
+			packets = append(packets, &audio)
+		}
+	}
+
+	return packets, nil
+}
+
+// readDVAudio decodes the audio of a packet split from a DV type-1 chunk
+func readDVAudio(frame []byte) ([]byte, error) {
+	pcm, ok := extractDVAudio(frame)
+	if !ok {
+		return nil, &AVIError{Op: "read dv audio", Err: fmt.Errorf("no decodable audio in dv frame")}
+	}
+	return pcm, nil
+}
@@ -0,0 +1,189 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// buildDVFrame builds a 16-bit 48 kHz DV frame carrying the given stereo
+// samples, laid out in the audio blocks the way a camcorder shuffles them
+func buildDVFrame(system *dvSystem, samples []int16) []byte {
+	frame := make([]byte, system.sequences*dvSequenceSize)
+	if system == &dvSystem625 {
+		frame[3] = 0x80 // DSF
+	}
+
+	// AAUX source pack, AF_SIZE counted from the minimum at 48 kHz
+	copy(frame[dvAudioPackOffset:], []byte{dvAudioSourcePack, byte(len(samples)/2 - system.minSamples[0]), 0, 0, 0})
+
+	for i := 0; i < system.sequences; i++ {
+		for j := 0; j < 9; j++ {
+			block := frame[i*dvSequenceSize+(6+j*16)*dvBlockSize:][:dvBlockSize]
+			for d := 8; d < dvBlockSize; d += 2 {
+				if offset := system.audioShuffle[i][j] + (d-8)/2*system.audioStride; offset < len(samples) {
+					binary.BigEndian.PutUint16(block[d:], uint16(samples[offset]))
+				}
+			}
+		}
+	}
+	return frame
+}
+
+// testDVSamples returns count stereo samples numbered from start
+func testDVSamples(start, count int) []int16 {
+	samples := make([]int16, 2*count)
+	for i := range samples {
+		samples[i] = int16(start*2 + i - 3000)
+	}
+	return samples
+}
+
+func pcmBytes(samples []int16) []byte {
+	data := make([]byte, 2*len(samples))
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+	return data
+}
+
+func TestExtractDVAudio(t *testing.T) {
+	for _, system := range []*dvSystem{&dvSystem525, &dvSystem625} {
+		samples := testDVSamples(0, system.minSamples[0]+4)
+		pcm, ok := extractDVAudio(buildDVFrame(system, samples))
+		if !ok {
+			t.Fatalf("%d lines: expected audio", system.height)
+		}
+		if !bytes.Equal(pcm, pcmBytes(samples)) {
+			t.Errorf("%d lines: decoded samples differ", system.height)
+		}
+	}
+
+	if _, ok := extractDVAudio(make([]byte, dvSystem525.sequences*dvSequenceSize)); ok {
+		t.Error("Expected no audio without an AAUX source pack")
+	}
+
+	for sample, expected := range map[uint16]uint16{0x000: 0, 0x100: 0x100, 0x7FF: 0x7FC0, 0x800: 0, 0xFFF: 0xFFFF} {
+		if got := dvAudio12To16(sample); got != expected {
+			t.Errorf("dvAudio12To16(%#x): expected %#x, got %#x", sample, expected, got)
+		}
+	}
+}
+
+// buildDVType1AVI writes NTSC DV frames as a type-1 file: muxed as dvsd
+// video, then turned into an iavs stream with ##__ chunks and a DVINFO strf
+func buildDVType1AVI(t *testing.T, frameSamples []int) ([]byte, [][]int16) {
+	t.Helper()
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	writer.Create(buffer)
+	writer.AddStream(Codec{Name: "dvsd", FourCC: [4]byte{'d', 'v', 's', 'd'}, Type: StreamTypeVideo, Width: 720, Height: 480, TimeBase: Rational{Num: 1001, Den: 30000}})
+
+	var audio [][]int16
+	start := 0
+	for _, count := range frameSamples {
+		samples := testDVSamples(start, count)
+		start += count
+		audio = append(audio, samples)
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: buildDVFrame(&dvSystem525, samples), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := append([]byte(nil), buffer.Bytes()...)
+	copy(data[bytes.Index(data, []byte(STREAMTypeVideo)):], STREAMTypeDV)
+	data = bytes.ReplaceAll(data, []byte("00dc"), []byte("00__"))
+
+	var dvinfo bytes.Buffer
+	binary.Write(&dvinfo, binary.LittleEndian, DVInfo{VAuxSrc: 0xFF}) // 60 fields, 48 kHz
+	copy(data[bytes.Index(data, []byte(STRFChunk))+8:], dvinfo.Bytes())
+
+	return data, audio
+}
+
+func TestDVType1Reading(t *testing.T) {
+	data, audio := buildDVType1AVI(t, []int{1600, 1602, 1600})
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.VideoStreams != 1 || fileInfo.AudioStreams != 1 {
+		t.Errorf("Expected 1 video and 1 audio stream, got %d and %d", fileInfo.VideoStreams, fileInfo.AudioStreams)
+	}
+
+	streams, _ := reader.GetStreams()
+	if len(streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %d", len(streams))
+	}
+	if streams[0].Type != StreamTypeVideo || streams[0].Codec.Name != "dvsd" || streams[0].Codec.Width != 720 || streams[0].Codec.Height != 480 {
+		t.Errorf("Unexpected video stream %+v", streams[0])
+	}
+	if codec := streams[1].Codec; streams[1].Type != StreamTypeAudio || codec.SampleRate != 48000 || codec.Channels != 2 || codec.BitDepth != 16 {
+		t.Errorf("Unexpected audio stream %+v", streams[1])
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 6 {
+		t.Fatalf("Expected 6 packets, got %d", len(packets))
+	}
+	samplesBefore := 0
+	for i, samples := range audio {
+		video, sound := packets[2*i], packets[2*i+1]
+		if video.StreamIndex != 0 || len(video.Data) != 120000 {
+			t.Errorf("Frame %d: unexpected video packet of stream %d, %d bytes", i, video.StreamIndex, len(video.Data))
+		}
+		if sound.StreamIndex != 1 || sound.Codec != StreamTypeAudio || !bytes.Equal(sound.Data, pcmBytes(samples)) {
+			t.Errorf("Frame %d: unexpected audio packet of stream %d", i, sound.StreamIndex)
+		}
+		if expected := time.Duration(samplesBefore) * time.Second / 48000; sound.PTSTime != expected {
+			t.Errorf("Frame %d: expected audio at %v, got %v", i, expected, sound.PTSTime)
+		}
+		samplesBefore += len(samples) / 2
+	}
+
+	indexed, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	if len(indexed) != len(packets) {
+		t.Fatalf("Expected %d indexed packets, got %d", len(packets), len(indexed))
+	}
+	for i, packet := range indexed {
+		if packet.StreamIndex != packets[i].StreamIndex || packet.Size != packets[i].Size || packet.PTSTime != packets[i].PTSTime {
+			t.Errorf("Packet %d: indexed %+v differs from read %+v", i, packet, packets[i])
+		}
+	}
+	pcm, err := reader.ReadPacketData(&indexed[3])
+	if err != nil || !bytes.Equal(pcm, pcmBytes(audio[1])) {
+		t.Errorf("Expected ReadPacketData to decode the audio of frame 1, got %d bytes (%v)", len(pcm), err)
+	}
+
+	// A chunk without DV audio fails and leaves the file position alone
+	before, _ := reader.r.Seek(0, io.SeekCurrent)
+	broken := indexed[3]
+	broken.Position = int64(bytes.Index(data, []byte(STRHChunk)))
+	if _, err := reader.ReadPacketData(&broken); err == nil {
+		t.Error("Expected error decoding audio from a chunk that is not a DV frame")
+	}
+	if after, _ := reader.r.Seek(0, io.SeekCurrent); after != before {
+		t.Errorf("Expected the file position restored to %d, got %d", before, after)
+	}
+
+	// Both halves of the frame are returned after a seek
+	if err := reader.SeekWithMode(70*time.Millisecond, SeekExact); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	after := readAllSequential(t, reader)
+	if len(after) != 2 || after[0].StreamIndex != 0 || after[1].StreamIndex != 1 || !bytes.Equal(after[1].Data, pcmBytes(audio[2])) {
+		t.Errorf("Expected frame 2 and its audio after seeking, got %d packets", len(after))
+	}
+}
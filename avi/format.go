@@ -10,12 +10,16 @@ const (
 	// RIFF chunk identifiers
 	RIFFSignature = "RIFF"
 	AVISignature  = "AVI "
+	AVIXSignature = "AVIX" // OpenDML RIFF continuation
 	LISTSignature = "LIST"
 	
 	// AVI List types
 	HDRLList = "hdrl"
 	STRLList = "strl" 
 	MOVIList = "movi"
+	RECList  = "rec "
+	ODMLList = "odml"
+	INFOList = "INFO"
 	
 	// Chunk types
 	AVIHChunk = "avih"
@@ -25,11 +29,42 @@ const (
 	STRNChunk = "strn"
 	INDXChunk = "indx"
 	IDX1Chunk = "idx1"
+	JUNKChunk = "JUNK"
+	DMLHChunk = "dmlh"
+	
+	// OpenDML index types
+	AVIIndexOfIndexes = 0x00 // indx super index pointing to ix## chunks
+	AVIIndexOfChunks  = 0x01 // Standard index pointing to data chunks
+	AVIIndex2Field    = 0x01 // Index sub type for field indexes
+	AVIStdIndexDeltaFrame = 0x80000000 // Set in a standard index entry size for non keyframes
 	
 	// Stream types
 	STREAMTypeVideo = "vids"
 	STREAMTypeAudio = "auds"
 	STREAMTypeText  = "txts"
+	STREAMTypeDV    = "iavs" // DV type-1, video and audio in one stream
+	
+	// Index entry flags
+	AVIIFList     = 0x00000001 // Chunk is a LIST
+	AVIIFKeyframe = 0x00000010 // Chunk is a keyframe
+	AVIIFNoTime   = 0x00000100 // Chunk does not advance time
+	
+	// Main header flags
+	AVIFHasIndex      = 0x00000010 // File has an idx1 index
+	AVIFMustUseIndex  = 0x00000020 // Chunk order is given by the index, not the file
+	AVIFIsInterleaved = 0x00000100 // Streams are interleaved in time
+	AVIFTrustCKType   = 0x00000800 // The index chunk types can be trusted to identify keyframes
+	
+	// Stream header flags
+	AVISFDisabled        = 0x00000001 // Stream is not played by default
+	AVISFVideoPalChanges = 0x00010000 // Stream has palette changes
+	
+	// Audio format tags (WAVEFORMATEX wFormatTag)
+	WAVEFormatPCM        = 0x0001
+	WAVEFormatIEEEFloat  = 0x0003
+	WAVEFormatMPEGLayer3 = 0x0055
+	WAVEFormatAAC        = 0x00FF
+	WAVEFormatExtensible = 0xFFFE // WaveFormatExtensible follows, the format is in SubFormat
 	
 	// Video codecs (common ones)
 	CODECMjpeg = "MJPG"
@@ -122,6 +157,26 @@ type WaveFormatEx struct {
 	Size           uint16 // Extra format bytes
 }
 
+// WaveFormatExtensible follows WaveFormatEx when its format tag is
+// WAVEFormatExtensible, cbSize is at least 22
+type WaveFormatExtensible struct {
+	ValidBitsPerSample uint16   // Bits of precision in each sample
+	ChannelMask        uint32   // Speaker positions of the channels
+	SubFormat          [16]byte // Format GUID
+}
+
+// DVInfo is the strf of a DV type-1 stream: the AAUX and VAUX source and
+// control packs of the recording, without their pack header byte
+type DVInfo struct {
+	AAuxSrc  uint32 // Audio source pack of the first audio channels
+	AAuxCtl  uint32 // Audio control pack of the first audio channels
+	AAuxSrc1 uint32 // Audio source pack of the second audio channels
+	AAuxCtl1 uint32 // Audio control pack of the second audio channels
+	VAuxSrc  uint32 // Video source pack
+	VAuxCtl  uint32 // Video control pack
+	Reserved [2]uint32
+}
+
 // IndexEntry represents an index entry (idx1)
 type IndexEntry struct {
 	ChunkID [4]byte // Chunk identifier
@@ -130,6 +185,67 @@ type IndexEntry struct {
 	Size    uint32  // Chunk size
 }
 
+// AVIMetaIndex is the common header of OpenDML indexes (indx and ix## chunks)
+type AVIMetaIndex struct {
+	LongsPerEntry uint16  // Size of each entry in DWORDs
+	IndexSubType  uint8   // 0 or AVIIndex2Field
+	IndexType     uint8   // AVIIndexOfIndexes or AVIIndexOfChunks
+	EntriesInUse  uint32  // Number of valid entries
+	ChunkID       [4]byte // Chunk identifier of the indexed chunks
+}
+
+// AVISuperIndexEntry points to a standard index chunk (indx entries)
+type AVISuperIndexEntry struct {
+	Offset   uint64 // Absolute position of the ix## chunk
+	Size     uint32 // Size of the ix## chunk, header included
+	Duration uint32 // Time span of the indexed chunks in stream ticks
+}
+
+// AVIStdIndexEntry locates a data chunk (ix## entries)
+type AVIStdIndexEntry struct {
+	Offset uint32 // Offset of the chunk data from the index base offset
+	Size   uint32 // Chunk data size, AVIStdIndexDeltaFrame set for non keyframes
+}
+
+// SubFormatGUID returns the WaveFormatExtensible sub-format GUID of a
+// WAVEFORMATEX format tag, in its on-disk byte order
+func SubFormatGUID(formatTag uint16) [16]byte {
+	guid := [16]byte{0, 0, 0, 0, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+	binary.LittleEndian.PutUint16(guid[:], formatTag)
+	return guid
+}
+
+// SubFormatTag returns the format tag a sub-format GUID derives from, or
+// false for GUIDs outside the WAVEFORMATEX range
+func SubFormatTag(guid [16]byte) (uint16, bool) {
+	tag := binary.LittleEndian.Uint16(guid[:])
+	return tag, SubFormatGUID(tag) == guid
+}
+
+// DefaultChannelMask returns the usual speaker layout for a channel count,
+// such as 5.1 for 6 channels
+func DefaultChannelMask(channels int) uint32 {
+	switch channels {
+	case 1:
+		return 0x4 // FC
+	case 2:
+		return 0x3 // FL FR
+	case 3:
+		return 0x7 // FL FR FC
+	case 4:
+		return 0x33 // FL FR BL BR
+	case 5:
+		return 0x37 // FL FR FC BL BR
+	case 6:
+		return 0x3F // FL FR FC LFE BL BR
+	case 7:
+		return 0x13F // FL FR FC LFE BL BR BC
+	case 8:
+		return 0x63F // FL FR FC LFE BL BR SL SR
+	}
+	return 0
+}
+
 // Helper functions for chunk operations
 func MakeChunkID(streamIndex int, twoCC string) [4]byte {
 	var id [4]byte
@@ -140,6 +256,22 @@ func MakeChunkID(streamIndex int, twoCC string) [4]byte {
 	return id
 }
 
+// MakeIndexChunkID returns the identifier of a stream's OpenDML standard
+// index chunk, e.g. "ix01"
+func MakeIndexChunkID(streamIndex int) [4]byte {
+	return [4]byte{'i', 'x', byte('0' + (streamIndex / 10)), byte('0' + (streamIndex % 10))}
+}
+
+// ParseChunkID splits a movi chunk identifier such as "01wb" into its stream
+// index and two-character type code. ok is false for identifiers that do not
+// start with two decimal digits (LIST, JUNK, ix00, ...).
+func ParseChunkID(id [4]byte) (streamIndex int, twoCC string, ok bool) {
+	if id[0] < '0' || id[0] > '9' || id[1] < '0' || id[1] > '9' {
+		return 0, "", false
+	}
+	return int(id[0]-'0')*10 + int(id[1]-'0'), string(id[2:4]), true
+}
+
 func ChunkIDToString(id [4]byte) string {
 	return string(id[:])
 }
@@ -186,6 +318,14 @@ func IsAudioStream(streamType [4]byte) bool {
 	return string(streamType[:]) == STREAMTypeAudio
 }
 
+func IsTextStream(streamType [4]byte) bool {
+	return string(streamType[:]) == STREAMTypeText
+}
+
+func IsDVStream(streamType [4]byte) bool {
+	return string(streamType[:]) == STREAMTypeDV
+}
+
 // Error types
 type AVIError struct {
 	Op  string
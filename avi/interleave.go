@@ -0,0 +1,199 @@
+package avi
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultMaxInterleave is how far apart in time the Writer lets its streams
+// drift, and how far out of order chunks may be written for the file to
+// still be flagged as interleaved
+const DefaultMaxInterleave = 500 * time.Millisecond
+
+// queuedPacket is a packet held back by the interleaver
+type queuedPacket struct {
+	packet   Packet
+	dtsTime  time.Duration // Decode time from the stream's own clock
+	sequence int64         // Arrival order, breaks ties between equal times
+}
+
+// SetMaxInterleave sets how far ahead of the other streams a stream may be
+// buffered before its packets are written anyway. Callers that write their
+// streams one after the other need a duration covering the whole file to
+// get an interleaved file, at the cost of holding it in memory.
+func (w *Writer) SetMaxInterleave(duration time.Duration) error {
+	if duration <= 0 {
+		return &AVIError{Op: "set max interleave", Err: fmt.Errorf("duration %v out of range", duration)}
+	}
+	w.maxInterleave = duration
+	return nil
+}
+
+// SetAudioPreRoll sets how far ahead of the video audio streams are written,
+// recorded as their strh InitialFrames. Players use the pre-roll to fill
+// their audio buffers before the first frame; VirtualDub writes 0.75 s.
+// Audio streams given InitialFrames of their own keep them. It must be set
+// before the first packet.
+func (w *Writer) SetAudioPreRoll(duration time.Duration) error {
+	if w.segments > 0 {
+		return &AVIError{Op: "set audio pre-roll", Err: fmt.Errorf("header already written")}
+	}
+	if duration < 0 {
+		return &AVIError{Op: "set audio pre-roll", Err: fmt.Errorf("duration %v out of range", duration)}
+	}
+	w.audioPreRoll = duration
+	return nil
+}
+
+// interleaveLimit returns the configured max interleave duration
+func (w *Writer) interleaveLimit() time.Duration {
+	if w.maxInterleave == 0 {
+		return DefaultMaxInterleave
+	}
+	return w.maxInterleave
+}
+
+// queuePacket adds a packet to its stream's queue, timed from the packets
+// accepted for the stream before it. The data and palette changes are copied
+// as the caller may reuse them once WritePacket returns.
+func (w *Writer) queuePacket(packet Packet) {
+	streamIndex := packet.StreamIndex
+	packet.Data = append([]byte(nil), packet.Data...)
+	packet.PaletteChanges = append([]PaletteChange(nil), packet.PaletteChanges...)
+	for i, change := range packet.PaletteChanges {
+		packet.PaletteChanges[i].Entries = append([]uint32(nil), change.Entries...)
+	}
+
+	stream := w.streams[streamIndex]
+	ticks := int64(w.streamTicks(streamIndex, int64(stream.PacketCount), w.streamBytes[streamIndex])) + int64(stream.Start)
+	w.queues[streamIndex] = append(w.queues[streamIndex], queuedPacket{
+		packet:   packet,
+		dtsTime:  w.streamTimeBase(streamIndex).Duration(ticks) - time.Duration(stream.InitialFrames)*w.frameDuration(),
+		sequence: w.queued,
+	})
+	w.queued++
+}
+
+// flushQueues writes queued packets in decode time order. A packet waits
+// while a timed stream has nothing queued that could come before it, unless
+// the queued packets span more than the max interleave duration. With all
+// set, everything queued is written.
+func (w *Writer) flushQueues(all bool) error {
+	for {
+		next := w.nextQueued()
+		if next < 0 {
+			return nil
+		}
+
+		head := w.queues[next][0]
+		if !all && w.streamTimeBase(next).Valid() && w.queuesStarved() && w.queuedUntil()-head.dtsTime <= w.interleaveLimit() {
+			return nil
+		}
+
+		if err := w.writePacketData(head.packet); err != nil {
+			return err
+		}
+		w.queues[next][0] = queuedPacket{}
+		w.queues[next] = w.queues[next][1:]
+
+		// Untimed streams are written as they come and do not count
+		at := w.muxTime
+		if w.streamTimeBase(next).Valid() {
+			if head.dtsTime < w.muxTime-w.interleaveLimit() {
+				w.interleaved = false
+			}
+			if head.dtsTime > w.muxTime {
+				w.muxTime = head.dtsTime
+			}
+			at = head.dtsTime
+		}
+		w.trackRate(at, 8+int64(AlignSize(uint32(len(head.packet.Data)))))
+	}
+}
+
+// nextQueued returns the stream whose queued packet is due first, untimed
+// streams first, or -1 when nothing is queued
+func (w *Writer) nextQueued() int {
+	next := -1
+	for i, queue := range w.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		if !w.streamTimeBase(i).Valid() {
+			return i
+		}
+		if next < 0 {
+			next = i
+			continue
+		}
+		head, best := queue[0], w.queues[next][0]
+		if head.dtsTime < best.dtsTime || (head.dtsTime == best.dtsTime && head.sequence < best.sequence) {
+			next = i
+		}
+	}
+	return next
+}
+
+// queuesStarved reports whether a timed stream has nothing queued
+func (w *Writer) queuesStarved() bool {
+	for i, queue := range w.queues {
+		if len(queue) == 0 && w.streamTimeBase(i).Valid() {
+			return true
+		}
+	}
+	return false
+}
+
+// queuedUntil returns the latest decode time queued
+func (w *Writer) queuedUntil() time.Duration {
+	var until time.Duration
+	for _, queue := range w.queues {
+		if len(queue) > 0 && queue[len(queue)-1].dtsTime > until {
+			until = queue[len(queue)-1].dtsTime
+		}
+	}
+	return until
+}
+
+// frameDuration returns the frame duration of the first video stream, the
+// unit of InitialFrames, or zero without video
+func (w *Writer) frameDuration() time.Duration {
+	for _, stream := range w.streams {
+		if stream.Type == StreamTypeVideo {
+			return videoTimeBase(stream.Codec).Duration(1)
+		}
+	}
+	return 0
+}
+
+// startTicks returns the timestamp of a stream's first packet in ticks of
+// the stream's strh time base, written as its Start
+func (w *Writer) startTicks(packet *Packet) int64 {
+	stream := w.streams[packet.StreamIndex]
+	timeBase := w.streamTimeBase(packet.StreamIndex)
+	if stream.Type == StreamTypeSubtitle {
+		timeBase = stream.Codec.TimeBase
+	}
+	if !timeBase.Valid() {
+		return 0
+	}
+	if packet.PTSTime > 0 {
+		return timeBase.Ticks(packet.PTSTime)
+	}
+	return packet.PTS
+}
+
+// streamTimeBase returns the time base of a stream's strh ticks, invalid
+// for streams that carry no timing. Subtitle and data streams are too sparse
+// to be waited for and are written as they come.
+func (w *Writer) streamTimeBase(streamIndex int) Rational {
+	codec := w.streams[streamIndex].Codec
+	switch w.streams[streamIndex].Type {
+	case StreamTypeVideo:
+		return videoTimeBase(codec)
+	case StreamTypeAudio:
+		scale, rate, _ := audioTimeBase(codec)
+		return Rational{Num: int64(scale), Den: int64(rate)}
+	}
+	return Rational{}
+}
@@ -5,8 +5,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
+// DefaultMaxRIFFSize is the RIFF segment size at which the Writer rolls over
+// to a new RIFF AVIX segment, the usual OpenDML choice of 1 GiB
+const DefaultMaxRIFFSize = 1 << 30
+
+// superIndexEntries is the number of indx entries reserved per stream, which
+// caps a stream at that many RIFF segments
+const superIndexEntries = 256
+
 // NewMuxer creates a new AVI muxer
 func NewMuxer() Muxer {
 	return &Writer{}
@@ -17,11 +28,79 @@ func (w *Writer) Create(writer io.WriteSeeker) error {
 	w.w = writer
 	w.filename = "" // No filename when using writer directly
 	w.streams = nil
-	w.packets = nil
+	w.finalized = false
+	w.segments = 0
+	w.segmentIndex = nil
+	w.idx1 = nil
+	w.superIndexes = nil
+	w.firstSegmentFrames = 0
+	w.streamBytes = nil
+	w.queues = nil
+	w.queued = 0
+	w.muxTime = 0
+	w.interleaved = true
+	w.recOffset = 0
+	w.maxChunk = nil
+	w.maxRecList = 0
+	w.rateWindow = nil
+	w.rateBytes = 0
+	w.maxBytesPerSec = 0
+	w.metadata = nil
+	w.headerGiven = nil
+	w.chunkTypes = nil
+
+	return nil
+}
 
+// SetMaxRIFFSize sets the size at which a RIFF segment is closed and writing
+// continues in a new RIFF AVIX segment. Files larger than this are written as
+// OpenDML (AVI 2.0), with a legacy idx1 covering the first segment only.
+func (w *Writer) SetMaxRIFFSize(size int64) error {
+	// Standard index offsets are 32-bit relative to the segment's movi list
+	if size < 1024 || size > 0xFFFFFFFF {
+		return &AVIError{Op: "set max riff size", Err: fmt.Errorf("size %d out of range", size)}
+	}
+	w.maxRIFFSize = size
 	return nil
 }
 
+// SetMetadata sets an INFO tag of the file, such as "INAM" for the title,
+// "IART" for the artist or "ISFT" for the software. The INFO list is written
+// ahead of the movi list, so tags must be set before the first packet. An
+// empty value removes the tag.
+func (w *Writer) SetMetadata(tag, value string) error {
+	if w.w == nil {
+		return &AVIError{Op: "set metadata", Err: fmt.Errorf("file not created")}
+	}
+
+	if w.segments > 0 {
+		return &AVIError{Op: "set metadata", Err: fmt.Errorf("header already written")}
+	}
+
+	if len(tag) != 4 {
+		return &AVIError{Op: "set metadata", Err: fmt.Errorf("invalid INFO tag %q", tag)}
+	}
+
+	if value == "" {
+		delete(w.metadata, tag)
+		return nil
+	}
+
+	if w.metadata == nil {
+		w.metadata = make(map[string]string)
+	}
+	w.metadata[tag] = value
+	return nil
+}
+
+// SetRecLists makes the Writer wrap each video frame and the chunks that
+// follow it up to the next frame in a LIST rec, as read in one go by some
+// hardware and CD-era players. Without video, every chunk of the first
+// stream starts a new list.
+func (w *Writer) SetRecLists(enabled bool) {
+	w.recLists = enabled
+}
+
 // CreateFile creates a new AVI file for writing (convenience method)
 func (w *Writer) CreateFile(filename string) error {
 	file, err := os.Create(filename)
@@ -37,33 +116,108 @@ func (w *Writer) CreateFile(filename string) error {
 
 // AddStream adds a new stream to the file
 func (w *Writer) AddStream(codec Codec) (int, error) {
+	return w.addStream(codec, StreamHeader{}, false)
+}
+
+// AddStreamWithHeader adds a new stream to the file with its name, language,
+// flags and other strh fields, such as the StreamHeader of a Stream being
+// remuxed. The fields are written as given, a zero Quality included.
+func (w *Writer) AddStreamWithHeader(codec Codec, header StreamHeader) (int, error) {
+	return w.addStream(codec, header, true)
+}
+
+// addStream adds a stream, with its header when headerGiven is set
+func (w *Writer) addStream(codec Codec, header StreamHeader, headerGiven bool) (int, error) {
 	if w.w == nil {
 		return -1, &AVIError{Op: "add stream", Err: fmt.Errorf("file not created")}
 	}
 
+	if w.segments > 0 {
+		return -1, &AVIError{Op: "add stream", Err: fmt.Errorf("header already written")}
+	}
+
+	if len(codec.Palette) > 256 {
+		return -1, &AVIError{Op: "add stream", Err: fmt.Errorf("palette has %d entries, at most 256 allowed", len(codec.Palette))}
+	}
+
+	// A zero FourCC would be written as BI_RGB, which has to be asked for
+	if codec.Type == StreamTypeVideo && codec.FourCC == [4]byte{} && !codec.Uncompressed {
+		return -1, &AVIError{Op: "add stream", Err: fmt.Errorf("video stream has no FourCC, set Uncompressed for BI_RGB frames")}
+	}
+
+	if codec.Type == StreamTypeData && len(codec.RawHeader) == 0 {
+		return -1, &AVIError{Op: "add stream", Err: fmt.Errorf("data stream has no stream header")}
+	}
+
 	stream := Stream{
-		Index: len(w.streams),
-		Type:  codec.Type,
-		Codec: codec,
+		Index:        len(w.streams),
+		Type:         codec.Type,
+		Codec:        codec,
+		StreamHeader: header,
 	}
 
 	w.streams = append(w.streams, stream)
+	w.streamBytes = append(w.streamBytes, 0)
+	w.queues = append(w.queues, nil)
+	w.maxChunk = append(w.maxChunk, 0)
+	w.headerGiven = append(w.headerGiven, headerGiven)
+	w.chunkTypes = append(w.chunkTypes, "")
 	return stream.Index, nil
 }
 
 // WritePacket writes a packet to the file
+//
+// Packets are interleaved by decode time: a packet is held back until every
+// other stream has caught up with it or the max interleave duration is
+// exceeded (see SetMaxInterleave), then written to the movi list with only
+// its index entry kept in memory. The first packet writes the file header
+// with placeholder counts, so all streams must be added before it.
 func (w *Writer) WritePacket(packet *Packet) error {
 	if w.w == nil {
 		return &AVIError{Op: "write packet", Err: fmt.Errorf("file not created")}
 	}
 
-	if packet.StreamIndex >= len(w.streams) {
+	if w.finalized {
+		return &AVIError{Op: "write packet", Err: fmt.Errorf("file already finalized")}
+	}
+
+	if packet.StreamIndex < 0 || packet.StreamIndex >= len(w.streams) {
 		return &AVIError{Op: "write packet", Err: fmt.Errorf("invalid stream index")}
 	}
 
-	// Store packet for later writing
-	w.packets = append(w.packets, *packet)
-	return nil
+	for _, change := range packet.PaletteChanges {
+		if w.streams[packet.StreamIndex].Type != StreamTypeVideo || len(change.Entries) == 0 || change.FirstEntry < 0 || change.FirstEntry+len(change.Entries) > 256 {
+			return &AVIError{Op: "write packet", Err: fmt.Errorf("invalid palette change")}
+		}
+	}
+
+	if w.streams[packet.StreamIndex].Type == StreamTypeData {
+		if len(packet.ChunkType) != 2 {
+			return &AVIError{Op: "write packet", Err: fmt.Errorf("data packet has no chunk type")}
+		}
+		if w.chunkTypes[packet.StreamIndex] == "" {
+			w.chunkTypes[packet.StreamIndex] = packet.ChunkType
+		}
+	}
+
+	// A stream whose first packet is timed after zero starts late
+	if stream := &w.streams[packet.StreamIndex]; stream.PacketCount == 0 && stream.Start == 0 {
+		if start := w.startTicks(packet); start > 0 {
+			stream.Start = uint32(start)
+		}
+	}
+
+	if w.segments == 0 {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	w.queuePacket(*packet)
+	w.streams[packet.StreamIndex].PacketCount++
+	w.streamBytes[packet.StreamIndex] += int64(len(packet.Data))
+
+	return w.flushQueues(false)
 }
 
 // Finalize finalizes the file (writes headers, indices)
@@ -72,49 +226,178 @@ func (w *Writer) Finalize() error {
 		return &AVIError{Op: "finalize", Err: fmt.Errorf("file not created")}
 	}
 
-	// Write the complete AVI structure
-	if err := w.writeAVIFile(); err != nil {
+	if w.finalized {
+		return &AVIError{Op: "finalize", Err: fmt.Errorf("file already finalized")}
+	}
+
+	if w.segments == 0 {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.flushQueues(true); err != nil {
+		return err
+	}
+
+	if err := w.endSegment(); err != nil {
+		return err
+	}
+
+	w.finalized = true
+
+	// Rewrite the header now that frame counts and super indexes are known
+	end, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	if _, err := w.w.Seek(w.hdrlOffset, io.SeekStart); err != nil {
+		return &AVIError{Op: "seek to hdrl", Err: err}
+	}
+
+	if err := w.writeHDRLList(); err != nil {
 		return err
 	}
 
+	if _, err := w.w.Seek(end, io.SeekStart); err != nil {
+		return &AVIError{Op: "seek to end", Err: err}
+	}
+
 	return nil
 }
 
-// writeAVIFile writes the complete AVI file structure
-func (w *Writer) writeAVIFile() error {
-	// Calculate file size (we'll update this later)
-	moviSize := w.calculateMOVISize()
-	hdrlSize := w.calculateHDRLSize()
-	idx1Size := w.calculateIDX1Size()
-	
-	totalSize := 4 + hdrlSize + 8 + moviSize + 8 + idx1Size // AVI signature + hdrl + movi header + movi data + idx1 header + idx1 data
+// writeHeader starts the first RIFF segment, writing the header with the
+// counts known so far
+func (w *Writer) writeHeader() error {
+	if frame := w.frameDuration(); frame > 0 && w.audioPreRoll > 0 {
+		for i := range w.streams {
+			if w.streams[i].Type == StreamTypeAudio && w.streams[i].InitialFrames == 0 {
+				w.streams[i].InitialFrames = uint32((w.audioPreRoll + frame - 1) / frame)
+			}
+		}
+	}
+
+	w.segmentIndex = make([][]indexRecord, len(w.streams))
+	w.superIndexes = make([][]AVISuperIndexEntry, len(w.streams))
+
+	return w.startSegment()
+}
+
+// startSegment opens a RIFF segment and its movi list. The first segment is
+// RIFF AVI and carries the hdrl list, the following ones are RIFF AVIX.
+// Sizes are written as zero and patched by endSegment.
+func (w *Writer) startSegment() error {
+	pos, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	riffType := AVISignature
+	if w.segments > 0 {
+		riffType = AVIXSignature
+	}
 
-	// Write RIFF header
 	riffHeader := RIFFHeader{
 		Signature: StringToChunkID(RIFFSignature),
-		FileSize:  uint32(totalSize),
-		Type:      StringToChunkID(AVISignature),
+		FileSize:  0,
+		Type:      StringToChunkID(riffType),
 	}
 
 	if err := binary.Write(w.w, binary.LittleEndian, &riffHeader); err != nil {
 		return &AVIError{Op: "write riff header", Err: err}
 	}
 
-	// Write hdrl LIST
-	if err := w.writeHDRLList(); err != nil {
-		return err
+	w.riffOffset = pos
+
+	if w.segments == 0 {
+		w.hdrlOffset = pos + 12
+		if err := w.writeHDRLList(); err != nil {
+			return err
+		}
+		if err := w.writeINFOList(); err != nil {
+			return err
+		}
 	}
 
-	// Write movi LIST
-	if err := w.writeMOVIList(); err != nil {
+	if pos, err = w.w.Seek(0, io.SeekCurrent); err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	listHeader := LISTHeader{
+		ChunkHeader: ChunkHeader{
+			ID:   StringToChunkID(LISTSignature),
+			Size: 0,
+		},
+		Type: StringToChunkID(MOVIList),
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &listHeader); err != nil {
+		return &AVIError{Op: "write movi list", Err: err}
+	}
+
+	w.moviOffset = pos + 8
+	w.segments++
+	return nil
+}
+
+// endSegment writes the standard indexes of the current segment at the end
+// of its movi list, the legacy idx1 after the first movi list, and patches
+// the list and RIFF sizes
+func (w *Writer) endSegment() error {
+	if err := w.closeRecList(); err != nil {
 		return err
 	}
 
-	// Write idx1 chunk
-	if err := w.writeIDX1Chunk(); err != nil {
+	for i := range w.streams {
+		for _, entries := range stdIndexGroups(w.segmentIndex[i]) {
+			if err := w.writeStdIndex(i, entries); err != nil {
+				return err
+			}
+		}
+		w.segmentIndex[i] = w.segmentIndex[i][:0]
+	}
+
+	pos, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	if err := w.patchUint32(w.moviOffset-4, uint32(pos-w.moviOffset)); err != nil {
 		return err
 	}
 
+	if w.segments == 1 {
+		if err := w.writeIDX1Chunk(); err != nil {
+			return err
+		}
+		if pos, err = w.w.Seek(0, io.SeekCurrent); err != nil {
+			return &AVIError{Op: "get position", Err: err}
+		}
+	}
+
+	return w.patchUint32(w.riffOffset+4, uint32(pos-w.riffOffset-8))
+}
+
+// patchUint32 overwrites a size field and returns to the current position
+func (w *Writer) patchUint32(offset int64, value uint32) error {
+	pos, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	if _, err := w.w.Seek(offset, io.SeekStart); err != nil {
+		return &AVIError{Op: "seek to size", Err: err}
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, value); err != nil {
+		return &AVIError{Op: "patch size", Err: err}
+	}
+
+	if _, err := w.w.Seek(pos, io.SeekStart); err != nil {
+		return &AVIError{Op: "restore position", Err: err}
+	}
+
 	return nil
 }
 
@@ -147,9 +430,95 @@ func (w *Writer) writeHDRLList() error {
 		}
 	}
 
+	// Write odml LIST
+	if err := w.writeODMLList(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// writeINFOList writes the INFO tags, in tag order, as null terminated
+// strings
+func (w *Writer) writeINFOList() error {
+	if len(w.metadata) == 0 {
+		return nil
+	}
+
+	tags := make([]string, 0, len(w.metadata))
+	size := uint32(4) // INFO signature
+	for tag, value := range w.metadata {
+		tags = append(tags, tag)
+		size += 8 + AlignSize(uint32(len(value)+1))
+	}
+	sort.Strings(tags)
+
+	listHeader := LISTHeader{
+		ChunkHeader: ChunkHeader{
+			ID:   StringToChunkID(LISTSignature),
+			Size: size,
+		},
+		Type: StringToChunkID(INFOList),
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &listHeader); err != nil {
+		return &AVIError{Op: "write info list", Err: err}
+	}
+
+	for _, tag := range tags {
+		if err := w.writeRawChunk(tag, append([]byte(w.metadata[tag]), 0)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeODMLList writes the OpenDML extended header with the total frame
+// count of the whole file
+func (w *Writer) writeODMLList() error {
+	listHeader := LISTHeader{
+		ChunkHeader: ChunkHeader{
+			ID:   StringToChunkID(LISTSignature),
+			Size: 4 + 8 + 248,
+		},
+		Type: StringToChunkID(ODMLList),
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &listHeader); err != nil {
+		return &AVIError{Op: "write odml list", Err: err}
+	}
+
+	chunkHeader := ChunkHeader{
+		ID:   StringToChunkID(DMLHChunk),
+		Size: 248, // dwTotalFrames + dwFuture[61]
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &chunkHeader); err != nil {
+		return &AVIError{Op: "write dmlh header", Err: err}
+	}
+
+	var dmlh [62]uint32
+	dmlh[0] = w.countVideoFrames()
+
+	if err := binary.Write(w.w, binary.LittleEndian, &dmlh); err != nil {
+		return &AVIError{Op: "write dmlh", Err: err}
+	}
+
+	return nil
+}
+
+// countVideoFrames returns the number of video packets written so far
+func (w *Writer) countVideoFrames() uint32 {
+	var totalFrames uint32
+	for _, stream := range w.streams {
+		if stream.Type == StreamTypeVideo {
+			totalFrames += uint32(stream.PacketCount)
+		}
+	}
+	return totalFrames
+}
+
 // writeAVIHChunk writes the main AVI header
 func (w *Writer) writeAVIHChunk() error {
 	// Calculate values
@@ -163,29 +532,43 @@ func (w *Writer) writeAVIHChunk() error {
 		if stream.Type == StreamTypeVideo {
 			width = uint32(stream.Codec.Width)
 			height = uint32(stream.Codec.Height)
-			if stream.Codec.FPS > 0 {
-				microSecPerFrame = uint32(1000000.0 / stream.Codec.FPS)
+			if timeBase := videoTimeBase(stream.Codec); timeBase.Valid() {
+				microSecPerFrame = uint32(timeBase.Duration(1) / time.Microsecond)
 			}
 			break
 		}
 	}
 
-	// Count frames
-	for _, packet := range w.packets {
-		if w.streams[packet.StreamIndex].Type == StreamTypeVideo {
-			totalFrames++
+	// Only the frames of the first RIFF segment are counted here, the
+	// total is in the OpenDML dmlh chunk
+	totalFrames = w.firstSegmentFrames
+
+	maxBytesPerSec = uint32(w.maxBytesPerSec)
+
+	// A player reading a rec list at a time needs room for the whole list
+	suggestedBufferSize := w.maxRecList
+	for _, size := range w.maxChunk {
+		if size > suggestedBufferSize {
+			suggestedBufferSize = size
 		}
 	}
 
+	// The index keyframe flags and chunk types are written from the packets
+	// themselves, so players may rely on them
+	var flags uint32 = AVIFHasIndex | AVIFTrustCKType
+	if w.interleaved {
+		flags |= AVIFIsInterleaved
+	}
+
 	header := AVIMainHeader{
 		MicroSecPerFrame:    microSecPerFrame,
 		MaxBytesPerSec:      maxBytesPerSec,
 		PaddingGranularity:  0,
-		Flags:               0x810, // AVIF_HASINDEX | AVIF_ISINTERLEAVED
+		Flags:               flags,
 		TotalFrames:         totalFrames,
 		InitialFrames:       0,
 		Streams:             uint32(len(w.streams)),
-		SuggestedBufferSize: 0,
+		SuggestedBufferSize: suggestedBufferSize,
 		Width:               width,
 		Height:              height,
 		Reserved:            [4]uint32{0, 0, 0, 0},
@@ -235,6 +618,102 @@ func (w *Writer) writeSTRLList(streamIndex int) error {
 		return err
 	}
 
+	// Write strd and strn chunks
+	if data := w.streams[streamIndex].DriverData; len(data) > 0 {
+		if err := w.writeRawChunk(STRDChunk, data); err != nil {
+			return err
+		}
+	}
+
+	if name := w.streams[streamIndex].Name; name != "" {
+		if err := w.writeRawChunk(STRNChunk, append([]byte(name), 0)); err != nil {
+			return err
+		}
+	}
+
+	// Write indx chunk
+	if err := w.writeSuperIndex(streamIndex); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeRawChunk writes a chunk holding data as is, padded to an even size
+func (w *Writer) writeRawChunk(id string, data []byte) error {
+	chunkHeader := ChunkHeader{
+		ID:   StringToChunkID(id),
+		Size: uint32(len(data)),
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &chunkHeader); err != nil {
+		return &AVIError{Op: "write " + id + " header", Err: err}
+	}
+
+	if _, err := w.w.Write(data); err != nil {
+		return &AVIError{Op: "write " + id, Err: err}
+	}
+
+	if len(data)%2 == 1 {
+		if _, err := w.w.Write([]byte{0}); err != nil {
+			return &AVIError{Op: "write padding", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// writeSuperIndex writes a stream's OpenDML super index, with room for
+// superIndexEntries ix## chunks
+func (w *Writer) writeSuperIndex(streamIndex int) error {
+	var entries []AVISuperIndexEntry
+	if streamIndex < len(w.superIndexes) {
+		entries = w.superIndexes[streamIndex]
+	}
+
+	chunkHeader := ChunkHeader{
+		ID:   StringToChunkID(INDXChunk),
+		Size: 24 + 16*superIndexEntries,
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &chunkHeader); err != nil {
+		return &AVIError{Op: "write indx header", Err: err}
+	}
+
+	header := AVIMetaIndex{
+		LongsPerEntry: 4,
+		IndexSubType:  0,
+		IndexType:     AVIIndexOfIndexes,
+		EntriesInUse:  uint32(len(entries)),
+		ChunkID:       w.chunkID(streamIndex),
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &header); err != nil {
+		return &AVIError{Op: "write indx", Err: err}
+	}
+
+	var slots [3 + 4*superIndexEntries]uint32 // dwReserved[3] + entries
+	if err := binary.Write(w.w, binary.LittleEndian, &slots); err != nil {
+		return &AVIError{Op: "write indx entries", Err: err}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Fill in the entries in use over the zeroed slots
+	if _, err := w.w.Seek(-16*superIndexEntries, io.SeekCurrent); err != nil {
+		return &AVIError{Op: "seek to indx entries", Err: err}
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, entries); err != nil {
+		return &AVIError{Op: "write indx entries", Err: err}
+	}
+
+	if _, err := w.w.Seek(int64(16*(superIndexEntries-len(entries))), io.SeekCurrent); err != nil {
+		return &AVIError{Op: "skip indx entries", Err: err}
+	}
+
 	return nil
 }
 
@@ -242,54 +721,65 @@ func (w *Writer) writeSTRLList(streamIndex int) error {
 func (w *Writer) writeSTRHChunk(streamIndex int) error {
 	stream := w.streams[streamIndex]
 
+	// Streams we do not understand keep the header they were read with
+	if stream.Type == StreamTypeData {
+		return w.writeRawChunk(STRHChunk, stream.Codec.RawHeader)
+	}
+
 	var streamType [4]byte
 	if stream.Type == StreamTypeVideo {
 		streamType = StringToChunkID(STREAMTypeVideo)
 	} else if stream.Type == StreamTypeAudio {
 		streamType = StringToChunkID(STREAMTypeAudio)
+	} else if stream.Type == StreamTypeSubtitle {
+		streamType = StringToChunkID(STREAMTypeText)
 	}
 
 	// Calculate scale and rate
-	var scale, rate uint32 = 1, 1
-	if stream.Type == StreamTypeVideo && stream.Codec.FPS > 0 {
-		scale = 1000
-		rate = uint32(stream.Codec.FPS * 1000)
+	var scale, rate, sampleSize uint32 = 1, 1, 0
+	if timeBase := videoTimeBase(stream.Codec); stream.Type == StreamTypeVideo && timeBase.Valid() {
+		scale = uint32(timeBase.Num)
+		rate = uint32(timeBase.Den)
 	} else if stream.Type == StreamTypeAudio && stream.Codec.SampleRate > 0 {
-		scale = 1
-		rate = uint32(stream.Codec.SampleRate)
+		scale, rate, sampleSize = audioTimeBase(stream.Codec)
+	} else if stream.Type == StreamTypeSubtitle && stream.Codec.TimeBase.Valid() {
+		scale = uint32(stream.Codec.TimeBase.Num)
+		rate = uint32(stream.Codec.TimeBase.Den)
 	}
 
-	// Count packets for this stream
-	var length uint32
-	for _, packet := range w.packets {
-		if packet.StreamIndex == streamIndex {
-			length++
-		}
+	length := w.streamTicks(streamIndex, int64(stream.PacketCount), w.streamBytes[streamIndex])
+
+	// Streams added without a header get the default quality
+	quality := stream.Quality
+	if quality == 0 && !w.headerGiven[streamIndex] {
+		quality = 0xFFFFFFFF
 	}
 
 	header := AVIStreamHeader{
 		Type:                streamType,
 		Handler:             stream.Codec.FourCC,
-		Flags:               0,
-		Priority:            0,
-		Language:            0,
-		InitialFrames:       0,
+		Flags:               stream.Flags,
+		Priority:            stream.Priority,
+		Language:            stream.Language,
+		InitialFrames:       stream.InitialFrames,
 		Scale:               scale,
 		Rate:                rate,
-		Start:               0,
+		Start:               stream.Start,
 		Length:              length,
-		SuggestedBufferSize: 0,
-		Quality:             0xFFFFFFFF,
-		SampleSize:          0,
+		SuggestedBufferSize: w.maxChunk[streamIndex],
+		Quality:             quality,
+		SampleSize:          sampleSize,
 	}
 
-	// Set frame rectangle for video
-	if stream.Type == StreamTypeVideo {
-		header.Frame.Left = 0
-		header.Frame.Top = 0
-		header.Frame.Right = uint16(stream.Codec.Width)
-		header.Frame.Bottom = uint16(stream.Codec.Height)
+	// Set frame rectangle, the whole picture for video unless given
+	frame := stream.Frame
+	if frame == (FrameRect{}) && stream.Type == StreamTypeVideo {
+		frame = FrameRect{Right: stream.Codec.Width, Bottom: stream.Codec.Height}
 	}
+	header.Frame.Left = uint16(frame.Left)
+	header.Frame.Top = uint16(frame.Top)
+	header.Frame.Right = uint16(frame.Right)
+	header.Frame.Bottom = uint16(frame.Bottom)
 
 	// Write chunk header
 	chunkHeader := ChunkHeader{
@@ -316,6 +806,9 @@ func (w *Writer) writeSTRFChunk(streamIndex int) error {
 		return w.writeVideoFormat(streamIndex)
 	} else if stream.Type == StreamTypeAudio {
 		return w.writeAudioFormat(streamIndex)
+	} else if (stream.Type == StreamTypeSubtitle || stream.Type == StreamTypeData) && len(stream.Codec.ExtraData) > 0 {
+		// Subtitle and data streams have no format structure of our own
+		return w.writeRawChunk(STRFChunk, stream.Codec.ExtraData)
 	}
 
 	return nil
@@ -325,24 +818,48 @@ func (w *Writer) writeSTRFChunk(streamIndex int) error {
 func (w *Writer) writeVideoFormat(streamIndex int) error {
 	stream := w.streams[streamIndex]
 
+	extraData := stream.Codec.ExtraData
+
+	bitCount := stream.Codec.BitCount
+	if bitCount == 0 {
+		bitCount = 24 // Default
+	}
+
+	compression := stream.Codec.FourCC
+	if isUncompressed(stream.Codec) {
+		compression = [4]byte{} // BI_RGB
+	}
+
+	// Uncompressed frames have a known size, rows padded to 4 bytes
+	sizeImage := stream.Codec.SizeImage
+	if sizeImage == 0 && isUncompressed(stream.Codec) {
+		height := stream.Codec.Height
+		if height < 0 {
+			height = -height
+		}
+		sizeImage = (stream.Codec.Width*bitCount + 31) / 32 * 4 * height
+	}
+
+	palette := stream.Codec.Palette
+
 	bih := BitmapInfoHeader{
-		Size:          40, // sizeof(BitmapInfoHeader)
+		Size:          uint32(40 + len(extraData)), // sizeof(BitmapInfoHeader) and the data following it
 		Width:         int32(stream.Codec.Width),
 		Height:        int32(stream.Codec.Height),
 		Planes:        1,
-		BitCount:      24, // Default
-		Compression:   stream.Codec.FourCC,
-		SizeImage:     0,
+		BitCount:      uint16(bitCount),
+		Compression:   compression,
+		SizeImage:     uint32(sizeImage),
 		XPelsPerMeter: 0,
 		YPelsPerMeter: 0,
-		ClrUsed:       0,
+		ClrUsed:       uint32(len(palette)),
 		ClrImportant:  0,
 	}
 
 	// Write chunk header
 	chunkHeader := ChunkHeader{
 		ID:   StringToChunkID(STRFChunk),
-		Size: 40, // sizeof(BitmapInfoHeader)
+		Size: uint32(40 + len(extraData) + 4*len(palette)), // sizeof(BitmapInfoHeader)
 	}
 
 	if err := binary.Write(w.w, binary.LittleEndian, &chunkHeader); err != nil {
@@ -353,27 +870,74 @@ func (w *Writer) writeVideoFormat(streamIndex int) error {
 		return &AVIError{Op: "write bitmap info", Err: err}
 	}
 
-	return nil
+	// The palette follows the codec private data, as RGBQUADs
+	data := append([]byte(nil), extraData...)
+	for _, entry := range palette {
+		data = binary.LittleEndian.AppendUint32(data, entry)
+	}
+
+	return w.writeExtraData(data, chunkHeader.Size)
 }
 
 // writeAudioFormat writes audio format info
 func (w *Writer) writeAudioFormat(streamIndex int) error {
 	stream := w.streams[streamIndex]
 
+	blockAlign := audioBlockAlign(stream.Codec)
+	extensible := isExtensible(stream.Codec)
+
 	wfx := WaveFormatEx{
-		FormatTag:      1, // PCM
+		FormatTag:      audioFormatTag(stream.Codec),
 		Channels:       uint16(stream.Codec.Channels),
 		SamplesPerSec:  uint32(stream.Codec.SampleRate),
-		AvgBytesPerSec: uint32(stream.Codec.SampleRate * stream.Codec.Channels * stream.Codec.BitDepth / 8),
-		BlockAlign:     uint16(stream.Codec.Channels * stream.Codec.BitDepth / 8),
+		AvgBytesPerSec: uint32(stream.Codec.AvgBytesPerSec),
+		BlockAlign:     uint16(blockAlign),
 		BitsPerSample:  uint16(stream.Codec.BitDepth),
-		Size:           0,
+		Size:           uint16(len(stream.Codec.ExtraData)),
+	}
+
+	var ext WaveFormatExtensible
+	if extensible {
+		// Samples are stored in whole bytes, the precision goes in the
+		// extensible block
+		ext = WaveFormatExtensible{
+			ValidBitsPerSample: uint16(stream.Codec.ValidBitsPerSample),
+			ChannelMask:        stream.Codec.ChannelMask,
+			SubFormat:          stream.Codec.SubFormat,
+		}
+		if ext.ValidBitsPerSample == 0 {
+			ext.ValidBitsPerSample = uint16(stream.Codec.BitDepth)
+		}
+		if ext.ChannelMask == 0 {
+			ext.ChannelMask = DefaultChannelMask(stream.Codec.Channels)
+		}
+		if ext.SubFormat == [16]byte{} {
+			tag := wfx.FormatTag
+			if tag == WAVEFormatExtensible {
+				tag = WAVEFormatPCM
+			}
+			ext.SubFormat = SubFormatGUID(tag)
+		}
+		wfx.FormatTag = WAVEFormatExtensible
+		wfx.BitsPerSample = uint16(containerBits(stream.Codec.BitDepth))
+		wfx.Size += 22 // sizeof(WaveFormatExtensible)
+	}
+
+	if wfx.AvgBytesPerSec == 0 {
+		if stream.Codec.VBR {
+			// Only known once every frame has been written
+			if stream.PacketCount > 0 {
+				wfx.AvgBytesPerSec = uint32(w.streamBytes[streamIndex] * int64(stream.Codec.SampleRate) / (int64(stream.PacketCount) * int64(samplesPerFrame(stream.Codec))))
+			}
+		} else {
+			wfx.AvgBytesPerSec = uint32(stream.Codec.SampleRate * blockAlign)
+		}
 	}
 
 	// Write chunk header
 	chunkHeader := ChunkHeader{
 		ID:   StringToChunkID(STRFChunk),
-		Size: 16, // sizeof(WaveFormatEx) without extra data
+		Size: audioFormatSize(stream.Codec),
 	}
 
 	if err := binary.Write(w.w, binary.LittleEndian, &chunkHeader); err != nil {
@@ -384,50 +948,217 @@ func (w *Writer) writeAudioFormat(streamIndex int) error {
 		return &AVIError{Op: "write wave format", Err: err}
 	}
 
+	if extensible {
+		if err := binary.Write(w.w, binary.LittleEndian, &ext); err != nil {
+			return &AVIError{Op: "write wave format extensible", Err: err}
+		}
+	}
+
+	return w.writeExtraData(stream.Codec.ExtraData, chunkHeader.Size)
+}
+
+// writeExtraData writes the codec private data ending a strf chunk of the
+// given size, padded to an even length
+func (w *Writer) writeExtraData(extraData []byte, chunkSize uint32) error {
+	if _, err := w.w.Write(extraData); err != nil {
+		return &AVIError{Op: "write extra data", Err: err}
+	}
+
+	if chunkSize%2 == 1 {
+		if _, err := w.w.Write([]byte{0}); err != nil {
+			return &AVIError{Op: "write strf padding", Err: err}
+		}
+	}
+
 	return nil
 }
 
-// writeMOVIList writes the movie data list
-func (w *Writer) writeMOVIList() error {
-	moviSize := w.calculateMOVISize()
+// isUncompressed reports whether a video stream holds BI_RGB frames
+func isUncompressed(codec Codec) bool {
+	return codec.Uncompressed || string(codec.FourCC[:]) == "DIB "
+}
 
-	// Write LIST header
-	listHeader := LISTHeader{
-		ChunkHeader: ChunkHeader{
-			ID:   StringToChunkID(LISTSignature),
-			Size: moviSize,
-		},
-		Type: StringToChunkID(MOVIList),
+// audioTimeBase returns the strh scale, rate and sample size of an audio
+// stream. VBR streams tick once per frame, others once per sample block.
+func audioTimeBase(codec Codec) (uint32, uint32, uint32) {
+	var sampleSize uint32
+	scale, rate := uint32(1), uint32(codec.SampleRate)
+	if codec.VBR {
+		scale = uint32(samplesPerFrame(codec))
+	} else if blockAlign := audioBlockAlign(codec); blockAlign > 0 {
+		sampleSize = uint32(blockAlign)
+		// Compressed CBR blocks tick at the byte rate rather than per sample
+		if codec.AvgBytesPerSec > 0 && codec.AvgBytesPerSec != codec.SampleRate*blockAlign {
+			scale, rate = uint32(blockAlign), uint32(codec.AvgBytesPerSec)
+		}
+	}
+	if codec.TimeBase.Valid() {
+		scale, rate = uint32(codec.TimeBase.Num), uint32(codec.TimeBase.Den)
 	}
+	return scale, rate, sampleSize
+}
 
-	if err := binary.Write(w.w, binary.LittleEndian, &listHeader); err != nil {
-		return &AVIError{Op: "write movi list", Err: err}
+// videoTimeBase returns the time base a video stream is written with, the
+// codec's own or one derived from its frame rate
+func videoTimeBase(codec Codec) Rational {
+	if codec.TimeBase.Valid() {
+		return codec.TimeBase
 	}
+	return FrameRateTimeBase(codec.FPS)
+}
 
-	// Write packets
-	for _, packet := range w.packets {
-		if err := w.writePacketData(packet); err != nil {
-			return err
+// samplesPerFrame returns the frame length of a VBR audio stream
+func samplesPerFrame(codec Codec) int {
+	if codec.SamplesPerFrame > 0 {
+		return codec.SamplesPerFrame
+	}
+	if audioFormatTag(codec) == WAVEFormatAAC {
+		return 1024
+	}
+	return 1152
+}
+
+// audioBlockAlign returns the nBlockAlign of an audio stream. VBR streams
+// store their frame length there.
+func audioBlockAlign(codec Codec) int {
+	if codec.BlockAlign > 0 {
+		return codec.BlockAlign
+	}
+	if codec.VBR {
+		return samplesPerFrame(codec)
+	}
+	return codec.Channels * containerBits(codec.BitDepth) / 8
+}
+
+// containerBits rounds a sample bit depth up to whole bytes
+func containerBits(bitDepth int) int {
+	return (bitDepth + 7) / 8 * 8
+}
+
+// isExtensible reports whether an audio stream is written with a
+// WaveFormatExtensible block: when asked for, or for PCM with more than two
+// channels or more than 16 bits per sample
+func isExtensible(codec Codec) bool {
+	switch audioFormatTag(codec) {
+	case WAVEFormatExtensible:
+		return true
+	case WAVEFormatPCM, WAVEFormatIEEEFloat:
+		return codec.Channels > 2 || codec.BitDepth > 16
+	}
+	return false
+}
+
+// audioFormatSize returns the size of an audio strf chunk
+func audioFormatSize(codec Codec) uint32 {
+	size := uint32(18 + len(codec.ExtraData)) // sizeof(WaveFormatEx) including cbSize
+	if isExtensible(codec) {
+		size += 22 // sizeof(WaveFormatExtensible)
+	}
+	return size
+}
+
+// audioFormatTag returns the wFormatTag of an audio stream, picked from its
+// codec name when not set
+func audioFormatTag(codec Codec) uint16 {
+	if codec.FormatTag != 0 {
+		return codec.FormatTag
+	}
+	switch strings.ToUpper(codec.Name) {
+	case "MP3":
+		return WAVEFormatMPEGLayer3
+	case "AAC":
+		return WAVEFormatAAC
+	}
+	return WAVEFormatPCM
+}
+
+// streamTicks converts packet and byte counts of a stream to strh ticks
+func (w *Writer) streamTicks(streamIndex int, packets, bytes int64) uint32 {
+	stream := w.streams[streamIndex]
+	if stream.Type == StreamTypeAudio && stream.Codec.SampleRate > 0 {
+		if _, _, sampleSize := audioTimeBase(stream.Codec); sampleSize > 0 {
+			return uint32(bytes / int64(sampleSize))
 		}
 	}
+	return uint32(packets)
+}
 
-	return nil
+// rateSample is a chunk counted towards the data rate
+type rateSample struct {
+	time  time.Duration
+	bytes int64
 }
 
-// writePacketData writes a single packet
+// trackRate records a chunk written at a decode time and updates the peak
+// data rate over a one second sliding window
+func (w *Writer) trackRate(at time.Duration, bytes int64) {
+	w.rateWindow = append(w.rateWindow, rateSample{time: at, bytes: bytes})
+	w.rateBytes += bytes
+
+	expired := 0
+	for expired < len(w.rateWindow) && w.rateWindow[expired].time <= at-time.Second {
+		w.rateBytes -= w.rateWindow[expired].bytes
+		expired++
+	}
+	w.rateWindow = w.rateWindow[expired:]
+
+	if w.rateBytes > w.maxBytesPerSec {
+		w.maxBytesPerSec = w.rateBytes
+	}
+}
+
+// writePacketData writes a single packet, rolling over to a new RIFF
+// segment first when it would not fit in the current one
 func (w *Writer) writePacketData(packet Packet) error {
-	// Create chunk ID (e.g., "00dc" for video, "01wb" for audio)
-	var twoCC string
-	if w.streams[packet.StreamIndex].Type == StreamTypeVideo {
-		twoCC = "dc" // compressed video
-		if packet.Flags == "K__" {
-			twoCC = "db" // uncompressed video
+	pos, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	newRec := w.recLists && (w.recOffset == 0 || w.startsRecList(packet.StreamIndex))
+	chunkSize := 8 + int64(AlignSize(uint32(len(packet.Data))))
+	if newRec {
+		chunkSize += 12
+	}
+	for _, change := range packet.PaletteChanges {
+		chunkSize += 8 + 4 + 4*int64(len(change.Entries)) + 16 + 8 // and its idx1 and ix## entries
+	}
+	if pos+chunkSize+w.pendingIndexSize()-w.riffOffset > w.riffSizeLimit() && w.segmentHasChunks() {
+		if err := w.endSegment(); err != nil {
+			return err
 		}
-	} else if w.streams[packet.StreamIndex].Type == StreamTypeAudio {
-		twoCC = "wb" // audio
+		if err := w.startSegment(); err != nil {
+			return err
+		}
+		if pos, err = w.w.Seek(0, io.SeekCurrent); err != nil {
+			return &AVIError{Op: "get position", Err: err}
+		}
+		newRec = w.recLists
+	}
+
+	if newRec {
+		if err := w.closeRecList(); err != nil {
+			return err
+		}
+		if err := w.openRecList(pos); err != nil {
+			return err
+		}
+		pos += 12
+	}
+
+	// Palette changes go right before the frame they apply to
+	for _, change := range packet.PaletteChanges {
+		if err := w.writePaletteChange(packet.StreamIndex, change, pos); err != nil {
+			return err
+		}
+		pos += 8 + 4 + 4*int64(len(change.Entries))
 	}
 
-	chunkID := MakeChunkID(packet.StreamIndex, twoCC)
+	// Create chunk ID (e.g., "00dc" for video, "01wb" for audio)
+	chunkID := w.chunkID(packet.StreamIndex)
+	if w.streams[packet.StreamIndex].Type == StreamTypeData {
+		chunkID = MakeChunkID(packet.StreamIndex, packet.ChunkType)
+	}
 
 	// Write chunk header
 	chunkHeader := ChunkHeader{
@@ -451,12 +1182,286 @@ func (w *Writer) writePacketData(packet Packet) error {
 		}
 	}
 
+	entry := indexRecord{
+		chunkID:  chunkID,
+		flags:    packet.Flags.indexFlags(),
+		position: pos,
+		size:     uint32(len(packet.Data)),
+	}
+
+	if entry.size > w.maxChunk[packet.StreamIndex] {
+		w.maxChunk[packet.StreamIndex] = entry.size
+	}
+
+	w.segmentIndex[packet.StreamIndex] = append(w.segmentIndex[packet.StreamIndex], entry)
+	if w.segments == 1 {
+		w.idx1 = append(w.idx1, entry)
+		if w.streams[packet.StreamIndex].Type == StreamTypeVideo {
+			w.firstSegmentFrames++
+		}
+	}
+
 	return nil
 }
 
-// writeIDX1Chunk writes the index chunk
+// writePaletteChange writes a ##pc chunk at pos. It is listed in idx1 as not
+// advancing time, and in a standard index of its own as an ix## holds a
+// single chunk ID.
+func (w *Writer) writePaletteChange(streamIndex int, change PaletteChange, pos int64) error {
+	data := []byte{byte(change.FirstEntry), byte(len(change.Entries)), 0, 0} // 256 entries wrap to 0
+	for _, entry := range change.Entries {
+		data = append(data, byte(entry>>16), byte(entry>>8), byte(entry), byte(entry>>24)) // PALETTEENTRY
+	}
+
+	chunkID := MakeChunkID(streamIndex, "pc")
+	if err := w.writeRawChunk(ChunkIDToString(chunkID), data); err != nil {
+		return err
+	}
+
+	entry := indexRecord{
+		chunkID:  chunkID,
+		flags:    AVIIFNoTime,
+		position: pos,
+		size:     uint32(len(data)),
+	}
+	w.segmentIndex[streamIndex] = append(w.segmentIndex[streamIndex], entry)
+	if w.segments == 1 {
+		w.idx1 = append(w.idx1, entry)
+	}
+
+	w.streams[streamIndex].Flags |= AVISFVideoPalChanges
+	return nil
+}
+
+// startsRecList reports whether a stream's chunks start a new rec list: those
+// of the first video stream, or of the first stream when there is no video
+func (w *Writer) startsRecList(streamIndex int) bool {
+	for _, stream := range w.streams {
+		if stream.Type == StreamTypeVideo {
+			return stream.Index == streamIndex
+		}
+	}
+	return streamIndex == 0
+}
+
+// openRecList writes the header of a rec list at pos, with its size left to
+// closeRecList, and indexes it in idx1 while in the first segment
+func (w *Writer) openRecList(pos int64) error {
+	listHeader := LISTHeader{
+		ChunkHeader: ChunkHeader{
+			ID:   StringToChunkID(LISTSignature),
+			Size: 0,
+		},
+		Type: StringToChunkID(RECList),
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &listHeader); err != nil {
+		return &AVIError{Op: "write rec list", Err: err}
+	}
+
+	w.recOffset = pos
+	w.recEntry = -1
+	if w.segments == 1 {
+		w.recEntry = len(w.idx1)
+		w.idx1 = append(w.idx1, indexRecord{
+			chunkID:  StringToChunkID(RECList),
+			flags:    AVIIFList,
+			position: pos,
+		})
+	}
+	return nil
+}
+
+// closeRecList patches the size of the open rec list, if any
+func (w *Writer) closeRecList() error {
+	if w.recOffset == 0 {
+		return nil
+	}
+
+	pos, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	size := uint32(pos - w.recOffset - 8)
+	if err := w.patchUint32(w.recOffset+4, size); err != nil {
+		return err
+	}
+	if size+8 > w.maxRecList {
+		w.maxRecList = size + 8
+	}
+	if w.recEntry >= 0 {
+		w.idx1[w.recEntry].size = size
+	}
+
+	w.recOffset = 0
+	return nil
+}
+
+// chunkID returns the movi chunk identifier of a stream's packets
+func (w *Writer) chunkID(streamIndex int) [4]byte {
+	var twoCC string
+	if w.streams[streamIndex].Type == StreamTypeVideo {
+		twoCC = "dc" // compressed video
+		if isUncompressed(w.streams[streamIndex].Codec) {
+			twoCC = "db" // uncompressed video
+		}
+	} else if w.streams[streamIndex].Type == StreamTypeAudio {
+		twoCC = "wb" // audio
+	} else if w.streams[streamIndex].Type == StreamTypeSubtitle {
+		twoCC = "tx" // subtitles
+	} else if w.streams[streamIndex].Type == StreamTypeData {
+		twoCC = w.chunkTypes[streamIndex] // as given by the first packet
+		if twoCC == "" {
+			twoCC = "dt"
+		}
+	}
+
+	return MakeChunkID(streamIndex, twoCC)
+}
+
+// riffSizeLimit returns the configured RIFF segment size limit
+func (w *Writer) riffSizeLimit() int64 {
+	if w.maxRIFFSize == 0 {
+		return DefaultMaxRIFFSize
+	}
+	return w.maxRIFFSize
+}
+
+// segmentHasChunks reports whether anything was written to the current segment
+func (w *Writer) segmentHasChunks() bool {
+	for _, entries := range w.segmentIndex {
+		if len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingIndexSize returns the room the current segment's indexes will take
+// once one more chunk is added to it
+func (w *Writer) pendingIndexSize() int64 {
+	entries := int64(1)
+	indexes := int64(len(w.streams)) + 1 // The chunk may be of a type of its own
+	for _, stream := range w.segmentIndex {
+		entries += int64(len(stream))
+		if groups := len(stdIndexGroups(stream)); groups > 1 {
+			indexes += int64(groups - 1)
+		}
+	}
+
+	size := indexes*(8+24) + entries*8 // ix## chunks
+	if w.segments == 1 {
+		idx1Entries := int64(len(w.idx1)) + 1
+		if w.recLists {
+			idx1Entries++ // The rec list the chunk may open
+		}
+		size += 8 + idx1Entries*16 // idx1
+	}
+	return size
+}
+
+// stdIndexGroups splits a stream's chunks in the current segment by chunk
+// ID, in order of first appearance. A standard index holds a single chunk ID,
+// so each group gets an ix## of its own.
+func stdIndexGroups(entries []indexRecord) [][]indexRecord {
+	var groups [][]indexRecord
+	for _, entry := range entries {
+		found := false
+		for i := range groups {
+			if groups[i][0].chunkID == entry.chunkID {
+				groups[i] = append(groups[i], entry)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []indexRecord{entry})
+		}
+	}
+	return groups
+}
+
+// writeStdIndex writes an ix## standard index of a stream's chunks of one
+// chunk ID in the current segment and records it in the stream's super index
+func (w *Writer) writeStdIndex(streamIndex int, entries []indexRecord) error {
+	if len(w.superIndexes[streamIndex]) >= superIndexEntries {
+		return &AVIError{Op: "write std index", Err: fmt.Errorf("stream %d exceeds %d standard indexes", streamIndex, superIndexEntries)}
+	}
+
+	pos, err := w.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return &AVIError{Op: "get position", Err: err}
+	}
+
+	size := uint32(24 + 8*len(entries))
+
+	chunkHeader := ChunkHeader{
+		ID:   MakeIndexChunkID(streamIndex),
+		Size: size,
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &chunkHeader); err != nil {
+		return &AVIError{Op: "write std index header", Err: err}
+	}
+
+	header := AVIMetaIndex{
+		LongsPerEntry: 2,
+		IndexSubType:  0,
+		IndexType:     AVIIndexOfChunks,
+		EntriesInUse:  uint32(len(entries)),
+		ChunkID:       entries[0].chunkID,
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &header); err != nil {
+		return &AVIError{Op: "write std index", Err: err}
+	}
+
+	// qwBaseOffset + dwReserved3
+	base := struct {
+		Offset   uint64
+		Reserved uint32
+	}{Offset: uint64(w.moviOffset)}
+
+	if err := binary.Write(w.w, binary.LittleEndian, &base); err != nil {
+		return &AVIError{Op: "write std index base", Err: err}
+	}
+
+	stdEntries := make([]AVIStdIndexEntry, len(entries))
+	bytes := int64(0)
+	for i, entry := range entries {
+		bytes += int64(entry.size)
+		stdEntries[i] = AVIStdIndexEntry{
+			Offset: uint32(entry.position + 8 - w.moviOffset), // Points at the chunk data
+			Size:   entry.size,
+		}
+		if entry.flags&AVIIFKeyframe == 0 {
+			stdEntries[i].Size |= AVIStdIndexDeltaFrame
+		}
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, stdEntries); err != nil {
+		return &AVIError{Op: "write std index entries", Err: err}
+	}
+
+	// Palette changes take no time
+	duration := w.streamTicks(streamIndex, int64(len(entries)), bytes)
+	if _, twoCC, _ := ParseChunkID(entries[0].chunkID); twoCC == "pc" {
+		duration = 0
+	}
+
+	w.superIndexes[streamIndex] = append(w.superIndexes[streamIndex], AVISuperIndexEntry{
+		Offset:   uint64(pos),
+		Size:     8 + size,
+		Duration: duration,
+	})
+
+	return nil
+}
+
+// writeIDX1Chunk writes the legacy index of the first RIFF segment
 func (w *Writer) writeIDX1Chunk() error {
-	indexSize := len(w.packets) * 16 // sizeof(IndexEntry)
+	indexSize := len(w.idx1) * 16 // sizeof(IndexEntry)
 
 	// Write chunk header
 	chunkHeader := ChunkHeader{
@@ -468,38 +1473,17 @@ func (w *Writer) writeIDX1Chunk() error {
 		return &AVIError{Op: "write idx1 header", Err: err}
 	}
 
-	var currentOffset uint32 = 4 // Skip movi signature
-	for _, packet := range w.packets {
-		var twoCC string
-		if w.streams[packet.StreamIndex].Type == StreamTypeVideo {
-			twoCC = "dc"
-			if packet.Flags == "K__" {
-				twoCC = "db"
-			}
-		} else if w.streams[packet.StreamIndex].Type == StreamTypeAudio {
-			twoCC = "wb"
-		}
-
-		chunkID := MakeChunkID(packet.StreamIndex, twoCC)
-
-		var flags uint32 = 0
-		if packet.Flags == "K__" {
-			flags = 0x10 // AVIIF_KEYFRAME
-		}
-
+	for _, record := range w.idx1 {
 		entry := IndexEntry{
-			ChunkID: chunkID,
-			Flags:   flags,
-			Offset:  currentOffset,
-			Size:    uint32(len(packet.Data)),
+			ChunkID: record.chunkID,
+			Flags:   record.flags,
+			Offset:  uint32(record.position - w.moviOffset), // Relative to the movi signature
+			Size:    record.size,
 		}
 
 		if err := binary.Write(w.w, binary.LittleEndian, &entry); err != nil {
 			return &AVIError{Op: "write index entry", Err: err}
 		}
-
-		// Update offset for next entry
-		currentOffset += 8 + AlignSize(uint32(len(packet.Data))) // chunk header + aligned data
 	}
 
 	return nil
@@ -514,36 +1498,39 @@ func (w *Writer) calculateHDRLSize() uint32 {
 		size += w.calculateSTRLSize(i) + 8 // strl size + LIST header
 	}
 
+	size += 8 + 4 + 8 + 248 // odml LIST header + dmlh chunk
+
 	return size
 }
 
 func (w *Writer) calculateSTRLSize(streamIndex int) uint32 {
 	size := uint32(4) // strl signature
-	size += 8 + 56    // strh chunk header + data
+	stream := w.streams[streamIndex]
+	if stream.Type == StreamTypeData {
+		size += 8 + AlignSize(uint32(len(stream.Codec.RawHeader))) // strh chunk header + raw header
+	} else {
+		size += 8 + 56 // strh chunk header + data
+	}
 
 	// strf chunk
-	stream := w.streams[streamIndex]
 	if stream.Type == StreamTypeVideo {
-		size += 8 + 40 // strf header + BitmapInfoHeader
+		size += 8 + AlignSize(uint32(40+len(stream.Codec.ExtraData)+4*len(stream.Codec.Palette))) // strf header + BitmapInfoHeader + extra data + palette
 	} else if stream.Type == StreamTypeAudio {
-		size += 8 + 16 // strf header + WaveFormatEx (no extra data)
+		size += 8 + AlignSize(audioFormatSize(stream.Codec)) // strf header + WaveFormatEx + extra data
+	} else if (stream.Type == StreamTypeSubtitle || stream.Type == StreamTypeData) && len(stream.Codec.ExtraData) > 0 {
+		size += 8 + AlignSize(uint32(len(stream.Codec.ExtraData))) // strf header + extra data
 	}
 
-	return size
-}
-
-func (w *Writer) calculateMOVISize() uint32 {
-	size := uint32(4) // movi signature
-
-	for _, packet := range w.packets {
-		size += 8 + AlignSize(uint32(len(packet.Data))) // chunk header + aligned data
+	if len(stream.DriverData) > 0 {
+		size += 8 + AlignSize(uint32(len(stream.DriverData))) // strd
+	}
+	if stream.Name != "" {
+		size += 8 + AlignSize(uint32(len(stream.Name)+1)) // strn, null terminated
 	}
 
-	return size
-}
+	size += 8 + 24 + 16*superIndexEntries // indx header + super index
 
-func (w *Writer) calculateIDX1Size() uint32 {
-	return uint32(len(w.packets) * 16) // sizeof(IndexEntry)
+	return size
 }
 
 // Close closes the file
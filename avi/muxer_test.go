@@ -1,7 +1,10 @@
 package avi
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -115,6 +118,7 @@ func TestMuxerWritePacket(t *testing.T) {
 	// Add video stream
 	videoCodec := Codec{
 		Name:   "TEST",
+		FourCC: [4]byte{'T', 'E', 'S', 'T'},
 		Type:   StreamTypeVideo,
 		Width:  320,
 		Height: 240,
@@ -134,7 +138,7 @@ func TestMuxerWritePacket(t *testing.T) {
 		PTS:         0,
 		DTS:         0,
 		Duration:    1,
-		Flags:       "K__",
+		Flags:       PacketKeyframe,
 	}
 
 	err = muxer.WritePacket(invalidPacket)
@@ -150,7 +154,7 @@ func TestMuxerWritePacket(t *testing.T) {
 		PTS:         0,
 		DTS:         0,
 		Duration:    1,
-		Flags:       "K__",
+		Flags:       PacketKeyframe,
 	}
 
 	err = muxer.WritePacket(validPacket)
@@ -180,6 +184,7 @@ func TestMuxerFinalize(t *testing.T) {
 	// Add a stream and packet
 	codec := Codec{
 		Name:   "TEST",
+		FourCC: [4]byte{'T', 'E', 'S', 'T'},
 		Type:   StreamTypeVideo,
 		Width:  160,
 		Height: 120,
@@ -198,7 +203,7 @@ func TestMuxerFinalize(t *testing.T) {
 		PTS:         0,
 		DTS:         0,
 		Duration:    1,
-		Flags:       "K__",
+		Flags:       PacketKeyframe,
 	}
 
 	err = muxer.WritePacket(packet)
@@ -280,11 +285,11 @@ func TestMuxerFullWorkflow(t *testing.T) {
 			PTSTime:      time.Duration(i) * time.Second / 25,
 			DTSTime:      time.Duration(i) * time.Second / 25,
 			DurationTime: time.Second / 25,
-			Flags:        "K__",
+			Flags:        PacketKeyframe,
 		}
 
 		if i > 0 {
-			videoPacket.Flags = "___" // Non-keyframe
+			videoPacket.Flags = 0 // Non-keyframe
 		}
 
 		err = muxer.WritePacket(videoPacket)
@@ -303,7 +308,7 @@ func TestMuxerFullWorkflow(t *testing.T) {
 			PTSTime:      time.Duration(i*1024) * time.Second / 22050,
 			DTSTime:      time.Duration(i*1024) * time.Second / 22050,
 			DurationTime: time.Duration(1024) * time.Second / 22050,
-			Flags:        "K__",
+			Flags:        PacketKeyframe,
 		}
 
 		err = muxer.WritePacket(audioPacket)
@@ -365,4 +370,1451 @@ func TestMuxerFullWorkflow(t *testing.T) {
 	}
 
 	t.Logf("Successfully verified created AVI file")
-}
\ No newline at end of file
+}
+func TestMuxerOpenDMLSegments(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	writer := NewMuxer().(*Writer)
+
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+
+	if err := writer.SetMaxRIFFSize(100); err == nil {
+		t.Error("Expected error for a RIFF size too small to hold a header")
+	}
+
+	if err := writer.SetMaxRIFFSize(64 * 1024); err != nil {
+		t.Fatalf("Failed to set RIFF size: %v", err)
+	}
+
+	videoIndex, _ := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 64, Height: 48, FPS: 10.0})
+	audioIndex, _ := writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16})
+
+	const frames = 100
+	for i := 0; i < frames; i++ {
+		var flags PacketFlags
+		if i%10 == 0 {
+			flags = PacketKeyframe
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: bytes.Repeat([]byte{byte(i)}, 2001), Flags: flags}); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: audioIndex, Codec: StreamTypeAudio, Data: bytes.Repeat([]byte{byte(i)}, 1600), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	if segments := bytes.Count(data, []byte(AVIXSignature)); segments < 4 {
+		t.Errorf("Expected the file to roll over into several AVIX segments, got %d", segments)
+	}
+
+	// Every RIFF segment stays under the limit
+	for pos := 0; pos < len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size+8 > 64*1024 {
+			t.Errorf("RIFF segment at %d is %d bytes", pos, size+8)
+		}
+		pos += 8 + size
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.Duration != 10*time.Second {
+		t.Errorf("Expected duration of all segments (10s), got %v", fileInfo.Duration)
+	}
+
+	if len(reader.index) == 0 || len(reader.superIndexes[videoIndex]) < 4 {
+		t.Fatalf("Expected the OpenDML super index to list every segment")
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+
+	if len(packets) != 2*frames {
+		t.Fatalf("Expected %d packets, got %d", 2*frames, len(packets))
+	}
+
+	for i, packet := range packets {
+		payload, err := reader.ReadPacketData(&packet)
+		if err != nil {
+			t.Fatalf("Packet %d: %v", i, err)
+		}
+		if payload[0] != byte(i/2) || packet.StreamIndex != i%2 {
+			t.Errorf("Packet %d: got stream %d payload %d", i, packet.StreamIndex, payload[0])
+		}
+		if packet.StreamIndex == videoIndex && (packet.Flags&PacketKeyframe != 0) != (i/2%10 == 0) {
+			t.Errorf("Packet %d: unexpected flags %#x", i, packet.Flags)
+		}
+	}
+
+	// The legacy idx1 only covers the first segment
+	legacy := &Reader{}
+	if err := legacy.Open(bytes.NewReader(stripSuperIndexes(data)), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	firstSegment, err := legacy.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets from idx1 failed: %v", err)
+	}
+	if len(firstSegment) == 0 || len(firstSegment) >= 2*frames {
+		t.Errorf("Expected idx1 to cover the first segment only, got %d entries", len(firstSegment))
+	}
+}
+
+// stripSuperIndexes empties the OpenDML super indexes of a file written by
+// the muxer so that only its idx1 is used
+func stripSuperIndexes(data []byte) []byte {
+	data = append([]byte(nil), data...)
+	for pos := 0; ; {
+		i := bytes.Index(data[pos:], []byte(INDXChunk))
+		if i < 0 {
+			return data
+		}
+		pos += i + 8
+		binary.LittleEndian.PutUint32(data[pos+4:], 0) // nEntriesInUse
+	}
+}
+
+func TestMuxerStreamsPackets(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	muxer := NewMuxer()
+
+	if err := muxer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+
+	videoIndex, _ := muxer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 64, Height: 48, FPS: 25.0})
+
+	written := 0
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 4000)
+		if err := muxer.WritePacket(&Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: data, Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write packet %d: %v", i, err)
+		}
+		written += len(data)
+
+		if buffer.Len() < written {
+			t.Fatalf("Packet %d was not written through: %d bytes in output, %d bytes of data", i, buffer.Len(), written)
+		}
+	}
+
+	if _, err := muxer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16}); err == nil {
+		t.Error("Expected error when adding a stream after packets were written")
+	}
+
+	if err := muxer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	if err := muxer.WritePacket(&Packet{StreamIndex: videoIndex, Data: []byte{1}}); err == nil {
+		t.Error("Expected error when writing after finalize")
+	}
+
+	reader := &Reader{}
+	data := buffer.Bytes()
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	streams, _ := reader.GetStreams()
+	if len(streams) != 1 || streams[0].Duration != 800*time.Millisecond {
+		t.Errorf("Expected the patched strh length to give 800ms, got %v", streams[0].Duration)
+	}
+
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.Duration != 800*time.Millisecond {
+		t.Errorf("Expected the patched avih frame count to give 800ms, got %v", fileInfo.Duration)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 20 {
+		t.Errorf("Expected 20 packets, got %d", len(packets))
+	}
+}
+
+func TestMuxerVBRAudio(t *testing.T) {
+	tests := []struct {
+		name            string
+		formatTag       uint16
+		samplesPerFrame int
+	}{
+		{"MP3", WAVEFormatMPEGLayer3, 1152},
+		{"AAC", WAVEFormatAAC, 1024},
+	}
+
+	for _, test := range tests {
+		buffer := NewSeekableBuffer()
+		writer := &Writer{}
+		if err := writer.Create(buffer); err != nil {
+			t.Fatalf("%s: failed to create: %v", test.name, err)
+		}
+
+		audioIndex, err := writer.AddStream(Codec{Name: test.name, Type: StreamTypeAudio, Channels: 2, SampleRate: 44100, VBR: true})
+		if err != nil {
+			t.Fatalf("%s: failed to add stream: %v", test.name, err)
+		}
+
+		totalBytes := 0
+		for i := 0; i < 10; i++ {
+			data := make([]byte, 200+i*10)
+			totalBytes += len(data)
+			if err := writer.WritePacket(&Packet{StreamIndex: audioIndex, Codec: StreamTypeAudio, Data: data, Flags: PacketKeyframe}); err != nil {
+				t.Fatalf("%s: failed to write packet %d: %v", test.name, i, err)
+			}
+		}
+
+		if err := writer.Finalize(); err != nil {
+			t.Fatalf("%s: failed to finalize: %v", test.name, err)
+		}
+
+		data := buffer.Bytes()
+		strh := bytes.Index(data, []byte(STRHChunk)) + 8
+		if scale := binary.LittleEndian.Uint32(data[strh+20:]); scale != uint32(test.samplesPerFrame) {
+			t.Errorf("%s: expected strh Scale %d, got %d", test.name, test.samplesPerFrame, scale)
+		}
+		if sampleSize := binary.LittleEndian.Uint32(data[strh+44:]); sampleSize != 0 {
+			t.Errorf("%s: expected strh SampleSize 0, got %d", test.name, sampleSize)
+		}
+
+		strf := bytes.Index(data, []byte(STRFChunk)) + 8
+		if tag := binary.LittleEndian.Uint16(data[strf:]); tag != test.formatTag {
+			t.Errorf("%s: expected format tag 0x%04X, got 0x%04X", test.name, test.formatTag, tag)
+		}
+		if blockAlign := binary.LittleEndian.Uint16(data[strf+12:]); blockAlign != uint16(test.samplesPerFrame) {
+			t.Errorf("%s: expected BlockAlign %d, got %d", test.name, test.samplesPerFrame, blockAlign)
+		}
+		expectedRate := uint32(int64(totalBytes) * 44100 / int64(10*test.samplesPerFrame))
+		if rate := binary.LittleEndian.Uint32(data[strf+8:]); rate != expectedRate {
+			t.Errorf("%s: expected AvgBytesPerSec %d, got %d", test.name, expectedRate, rate)
+		}
+
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("%s: failed to open: %v", test.name, err)
+		}
+
+		streams, _ := reader.GetStreams()
+		if !streams[0].Codec.VBR || streams[0].Codec.SamplesPerFrame != test.samplesPerFrame {
+			t.Errorf("%s: expected VBR with %d samples per frame, got %+v", test.name, test.samplesPerFrame, streams[0].Codec)
+		}
+
+		frameDuration := time.Duration(test.samplesPerFrame) * time.Second / 44100
+		if expected := 10 * frameDuration; absDuration(streams[0].Duration-expected) > time.Microsecond {
+			t.Errorf("%s: expected duration %v, got %v", test.name, expected, streams[0].Duration)
+		}
+
+		packets, err := reader.ReadAllPackets()
+		if err != nil {
+			t.Fatalf("%s: ReadAllPackets failed: %v", test.name, err)
+		}
+
+		for i, packet := range packets {
+			expected := time.Duration(i*test.samplesPerFrame) * time.Second / 44100
+			if packet.PTS != int64(i) || absDuration(packet.PTSTime-expected) > time.Microsecond {
+				t.Errorf("%s: packet %d: expected PTS %d at %v, got %d at %v", test.name, i, i, expected, packet.PTS, packet.PTSTime)
+			}
+		}
+	}
+}
+
+func TestMuxerTimeBase(t *testing.T) {
+	tests := []struct {
+		name     string
+		codec    Codec
+		expected Rational
+	}{
+		{"NTSC from FPS", Codec{FPS: 29.97}, Rational{Num: 1001, Den: 30000}},
+		{"integer FPS", Codec{FPS: 25}, Rational{Num: 1000, Den: 25000}},
+		{"verbatim", Codec{FPS: 23.976, TimeBase: Rational{Num: 1, Den: 24}}, Rational{Num: 1, Den: 24}},
+	}
+
+	for _, test := range tests {
+		codec := test.codec
+		codec.Name = "MJPG"
+		codec.FourCC = [4]byte{'M', 'J', 'P', 'G'}
+		codec.Type = StreamTypeVideo
+		codec.Width = 16
+		codec.Height = 16
+
+		buffer := NewSeekableBuffer()
+		writer := &Writer{}
+		if err := writer.Create(buffer); err != nil {
+			t.Fatalf("%s: failed to create: %v", test.name, err)
+		}
+		if _, err := writer.AddStream(codec); err != nil {
+			t.Fatalf("%s: failed to add stream: %v", test.name, err)
+		}
+
+		frames := 3000
+		for i := 0; i < frames; i++ {
+			if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: []byte{byte(i)}, Flags: PacketKeyframe}); err != nil {
+				t.Fatalf("%s: failed to write packet %d: %v", test.name, i, err)
+			}
+		}
+
+		if err := writer.Finalize(); err != nil {
+			t.Fatalf("%s: failed to finalize: %v", test.name, err)
+		}
+
+		data := buffer.Bytes()
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("%s: failed to open: %v", test.name, err)
+		}
+
+		streams, _ := reader.GetStreams()
+		if streams[0].Codec.TimeBase != test.expected {
+			t.Errorf("%s: expected time base %v, got %v", test.name, test.expected, streams[0].Codec.TimeBase)
+		}
+
+		packets, err := reader.ReadAllPackets()
+		if err != nil {
+			t.Fatalf("%s: ReadAllPackets failed: %v", test.name, err)
+		}
+
+		// No drift after thousands of frames
+		last := packets[len(packets)-1]
+		expected := time.Duration(int64(frames-1)*test.expected.Num) * time.Second / time.Duration(test.expected.Den)
+		if last.PTSTime != expected {
+			t.Errorf("%s: expected last frame at %v, got %v", test.name, expected, last.PTSTime)
+		}
+	}
+}
+
+func TestFrameRateTimeBase(t *testing.T) {
+	tests := []struct {
+		fps      float64
+		expected Rational
+	}{
+		{23.976, Rational{Num: 1001, Den: 24000}},
+		{29.97, Rational{Num: 1001, Den: 30000}},
+		{59.94, Rational{Num: 1001, Den: 60000}},
+		{30, Rational{Num: 1000, Den: 30000}},
+		{12.5, Rational{Num: 1000, Den: 12500}},
+		{0, Rational{}},
+	}
+
+	for _, test := range tests {
+		if got := FrameRateTimeBase(test.fps); got != test.expected {
+			t.Errorf("FrameRateTimeBase(%v): expected %v, got %v", test.fps, test.expected, got)
+		}
+	}
+
+	if d := (Rational{Num: 1001, Den: 30000}).Duration(30000); d != 1001*time.Second {
+		t.Errorf("Expected 30000 NTSC ticks to last 1001s, got %v", d)
+	}
+}
+
+func TestMuxerExtraData(t *testing.T) {
+	avcC := []byte{0x01, 0x64, 0x00, 0x1F, 0xFF} // Odd length, the strf is padded
+	audioSpecificConfig := []byte{0x12, 0x10}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "H264", FourCC: [4]byte{'H', '2', '6', '4'}, Type: StreamTypeVideo, Width: 64, Height: 48, FPS: 25, ExtraData: avcC}); err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "AAC", Type: StreamTypeAudio, Channels: 2, SampleRate: 44100, VBR: true, ExtraData: audioSpecificConfig}); err != nil {
+		t.Fatalf("Failed to add audio stream: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: []byte{0, 0, 0, 1, 0x65}, Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeAudio, Data: []byte{0x21, 0x10, 0x04}, Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	streams, _ := reader.GetStreams()
+	if len(streams) != 2 {
+		t.Fatalf("Expected 2 streams, got %d", len(streams))
+	}
+
+	if !bytes.Equal(streams[0].Codec.ExtraData, avcC) {
+		t.Errorf("Expected video extra data %x, got %x", avcC, streams[0].Codec.ExtraData)
+	}
+
+	if !bytes.Equal(streams[1].Codec.ExtraData, audioSpecificConfig) {
+		t.Errorf("Expected audio extra data %x, got %x", audioSpecificConfig, streams[1].Codec.ExtraData)
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+
+	if len(packets) != 8 {
+		t.Errorf("Expected 8 packets, got %d", len(packets))
+	}
+}
+
+func TestMuxerFormatRoundTrip(t *testing.T) {
+	video := Codec{Name: "DIB", Type: StreamTypeVideo, Width: 17, Height: 10, FPS: 10, BitCount: 8, Uncompressed: true}
+	audio := Codec{Name: "MP3", Type: StreamTypeAudio, Channels: 2, SampleRate: 44100, FormatTag: WAVEFormatMPEGLayer3, BlockAlign: 1, AvgBytesPerSec: 16000}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(video); err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+	if _, err := writer.AddStream(audio); err != nil {
+		t.Fatalf("Failed to add audio stream: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 200), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeAudio, Data: make([]byte, 400), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	streams, _ := reader.GetStreams()
+
+	// Rows of 17 8-bit pixels are padded to 20 bytes
+	if streams[0].Codec.BitCount != 8 || streams[0].Codec.SizeImage != 200 {
+		t.Errorf("Expected 8 bits per pixel and a 200 byte image, got %d and %d", streams[0].Codec.BitCount, streams[0].Codec.SizeImage)
+	}
+
+	got := streams[1].Codec
+	if got.FormatTag != WAVEFormatMPEGLayer3 || got.BlockAlign != 1 || got.AvgBytesPerSec != 16000 {
+		t.Errorf("Expected MP3 format with BlockAlign 1 and 16000 bytes/s, got tag 0x%04X, %d, %d", got.FormatTag, got.BlockAlign, got.AvgBytesPerSec)
+	}
+
+	if got.TimeBase != (Rational{Num: 1, Den: 16000}) {
+		t.Errorf("Expected CBR audio to tick at the byte rate, got time base %v", got.TimeBase)
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+
+	n := 0
+	for _, packet := range packets {
+		if packet.Codec != StreamTypeAudio {
+			continue
+		}
+		// 400 bytes at 16000 bytes/s
+		if expected := time.Duration(n) * 25 * time.Millisecond; packet.PTSTime != expected {
+			t.Errorf("Audio packet %d: expected %v, got %v", n, expected, packet.PTSTime)
+		}
+		n++
+	}
+}
+
+func TestMuxerWaveFormatExtensible(t *testing.T) {
+	tests := []struct {
+		name      string
+		codec     Codec
+		subFormat uint16
+		bits      int
+		validBits int
+		mask      uint32
+	}{
+		{"5.1 24-bit", Codec{Channels: 6, SampleRate: 48000, BitDepth: 24}, WAVEFormatPCM, 24, 24, 0x3F},
+		{"20-bit in 24", Codec{Channels: 2, SampleRate: 48000, BitDepth: 24, ValidBitsPerSample: 20}, WAVEFormatPCM, 24, 20, 0x3},
+		{"float", Codec{Channels: 2, SampleRate: 48000, BitDepth: 32, FormatTag: WAVEFormatIEEEFloat}, WAVEFormatIEEEFloat, 32, 32, 0x3},
+		{"custom mask", Codec{Channels: 4, SampleRate: 48000, BitDepth: 16, ChannelMask: 0x107}, WAVEFormatPCM, 16, 16, 0x107},
+	}
+
+	for _, test := range tests {
+		codec := test.codec
+		codec.Name = "PCM"
+		codec.Type = StreamTypeAudio
+
+		buffer := NewSeekableBuffer()
+		writer := &Writer{}
+		if err := writer.Create(buffer); err != nil {
+			t.Fatalf("%s: failed to create: %v", test.name, err)
+		}
+		if _, err := writer.AddStream(codec); err != nil {
+			t.Fatalf("%s: failed to add stream: %v", test.name, err)
+		}
+
+		blockAlign := codec.Channels * test.bits / 8
+		for i := 0; i < 3; i++ {
+			if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeAudio, Data: make([]byte, 96*blockAlign), Flags: PacketKeyframe}); err != nil {
+				t.Fatalf("%s: failed to write packet %d: %v", test.name, i, err)
+			}
+		}
+
+		if err := writer.Finalize(); err != nil {
+			t.Fatalf("%s: failed to finalize: %v", test.name, err)
+		}
+
+		data := buffer.Bytes()
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("%s: failed to open: %v", test.name, err)
+		}
+
+		streams, _ := reader.GetStreams()
+		got := streams[0].Codec
+		if got.FormatTag != WAVEFormatExtensible {
+			t.Errorf("%s: expected extensible format tag, got 0x%04X", test.name, got.FormatTag)
+		}
+
+		if tag, ok := SubFormatTag(got.SubFormat); !ok || tag != test.subFormat {
+			t.Errorf("%s: expected sub-format 0x%04X, got %x", test.name, test.subFormat, got.SubFormat)
+		}
+
+		if got.BitDepth != test.bits || got.ValidBitsPerSample != test.validBits || got.ChannelMask != test.mask || got.BlockAlign != blockAlign {
+			t.Errorf("%s: got %d bits (%d valid), mask 0x%X, BlockAlign %d", test.name, got.BitDepth, got.ValidBitsPerSample, got.ChannelMask, got.BlockAlign)
+		}
+
+		if len(got.ExtraData) != 0 {
+			t.Errorf("%s: expected no extra data past the extensible block, got %x", test.name, got.ExtraData)
+		}
+
+		packets, err := reader.ReadAllPackets()
+		if err != nil {
+			t.Fatalf("%s: ReadAllPackets failed: %v", test.name, err)
+		}
+
+		// 96 samples at 48 kHz
+		if len(packets) != 3 || packets[2].PTSTime != 4*time.Millisecond {
+			t.Errorf("%s: expected the third packet at 4ms, got %+v", test.name, packets)
+		}
+	}
+
+	// Stereo 16-bit PCM keeps the plain WAVEFORMATEX
+	if isExtensible(Codec{Channels: 2, BitDepth: 16}) {
+		t.Error("Expected stereo 16-bit PCM not to be extensible")
+	}
+}
+
+func TestMuxerChunkIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		twoCC string
+	}{
+		{"MJPEG", Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}}, "dc"},
+		{"RGB", Codec{Name: "DIB", FourCC: [4]byte{'D', 'I', 'B', ' '}}, "db"},
+	}
+
+	for _, test := range tests {
+		codec := test.codec
+		codec.Type = StreamTypeVideo
+		codec.Width = 4
+		codec.Height = 4
+		codec.FPS = 25
+
+		write := func(codec Codec) []byte {
+			buffer := NewSeekableBuffer()
+			writer := &Writer{}
+			if err := writer.Create(buffer); err != nil {
+				t.Fatalf("%s: failed to create: %v", test.name, err)
+			}
+			if _, err := writer.AddStream(codec); err != nil {
+				t.Fatalf("%s: failed to add stream: %v", test.name, err)
+			}
+			for i := 0; i < 4; i++ {
+				var flags PacketFlags
+				if i%2 == 0 {
+					flags = PacketKeyframe
+				}
+				if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 48), Flags: flags}); err != nil {
+					t.Fatalf("%s: failed to write packet %d: %v", test.name, i, err)
+				}
+			}
+			if err := writer.Finalize(); err != nil {
+				t.Fatalf("%s: failed to finalize: %v", test.name, err)
+			}
+			return append([]byte(nil), buffer.Bytes()...)
+		}
+
+		data := write(codec)
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("%s: failed to open: %v", test.name, err)
+		}
+
+		packets, err := reader.ReadAllPackets()
+		if err != nil {
+			t.Fatalf("%s: ReadAllPackets failed: %v", test.name, err)
+		}
+
+		// The chunk ID follows the compression, keyframes are only flagged
+		for i, packet := range packets {
+			var header [4]byte
+			copy(header[:], data[packet.Position:])
+			if header != MakeChunkID(0, test.twoCC) {
+				t.Errorf("%s: packet %d: expected chunk %s, got %s", test.name, i, MakeChunkID(0, test.twoCC), header)
+			}
+			if (packet.Flags&PacketKeyframe != 0) != (i%2 == 0) {
+				t.Errorf("%s: packet %d: unexpected flags %#x", test.name, i, packet.Flags)
+			}
+		}
+
+		// Remuxing with the codec read back keeps the chunk IDs
+		streams, _ := reader.GetStreams()
+		if streams[0].Codec.Uncompressed != (test.twoCC == "db") {
+			t.Errorf("%s: expected Uncompressed %v", test.name, test.twoCC == "db")
+		}
+
+		other := "dc"
+		if test.twoCC == "dc" {
+			other = "db"
+		}
+		remuxed := write(streams[0].Codec)
+		if !bytes.Contains(remuxed, []byte("00"+test.twoCC)) || bytes.Contains(remuxed, []byte("00"+other)) {
+			t.Errorf("%s: remuxed file changed chunk IDs", test.name)
+		}
+	}
+
+	// Without a FourCC, frames are only taken as BI_RGB when flagged so
+	writer := &Writer{}
+	if err := writer.Create(NewSeekableBuffer()); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "h264", Type: StreamTypeVideo, Width: 4, Height: 4, FPS: 25}); err == nil {
+		t.Error("Expected error for a video stream without a FourCC")
+	}
+	if _, err := writer.AddStream(Codec{Type: StreamTypeVideo, Width: 4, Height: 4, FPS: 25, Uncompressed: true}); err != nil {
+		t.Errorf("Failed to add an uncompressed stream without a FourCC: %v", err)
+	}
+}
+
+func TestMuxerPacketFlags(t *testing.T) {
+	flags := []PacketFlags{
+		PacketKeyframe,
+		0,
+		PacketNoTime,
+		PacketKeyframe | PacketDiscard | PacketCorrupt,
+	}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25}); err != nil {
+		t.Fatalf("Failed to add stream: %v", err)
+	}
+	for i, f := range flags {
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: []byte{byte(i)}, Flags: f}); err != nil {
+			t.Fatalf("Failed to write packet %d: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	idx1 := bytes.LastIndex(data, []byte(IDX1Chunk)) + 8
+	expectedIndex := []uint32{AVIIFKeyframe, 0, AVIIFNoTime, AVIIFKeyframe}
+	for i, expected := range expectedIndex {
+		if got := binary.LittleEndian.Uint32(data[idx1+i*16+4:]); got != expected {
+			t.Errorf("Entry %d: expected idx1 flags %#x, got %#x", i, expected, got)
+		}
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+
+	// Discard and corrupt markers are not stored in the file
+	expected := []PacketFlags{PacketKeyframe, 0, PacketNoTime, PacketKeyframe}
+	for i, packet := range packets {
+		if packet.Flags != expected[i] {
+			t.Errorf("Packet %d: expected flags %#x, got %#x", i, expected[i], packet.Flags)
+		}
+	}
+}
+
+func TestMuxerInterleaving(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxInterleave time.Duration
+		interleaved   bool
+	}{
+		{"default", 0, false},
+		{"whole file", 10 * time.Second, true},
+	}
+
+	for _, test := range tests {
+		buffer := NewSeekableBuffer()
+		writer := &Writer{}
+		if err := writer.Create(buffer); err != nil {
+			t.Fatalf("%s: failed to create: %v", test.name, err)
+		}
+		if test.maxInterleave > 0 {
+			if err := writer.SetMaxInterleave(test.maxInterleave); err != nil {
+				t.Fatalf("%s: SetMaxInterleave failed: %v", test.name, err)
+			}
+		}
+		videoIndex, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25})
+		if err != nil {
+			t.Fatalf("%s: failed to add video stream: %v", test.name, err)
+		}
+		audioIndex, err := writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16})
+		if err != nil {
+			t.Fatalf("%s: failed to add audio stream: %v", test.name, err)
+		}
+
+		// Two seconds of video, then the matching audio in 40ms chunks
+		const frames = 50
+		data := make([]byte, 640)
+		for i := 0; i < frames; i++ {
+			data[0] = byte(i)
+			if err := writer.WritePacket(&Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: data[:100], Flags: PacketKeyframe}); err != nil {
+				t.Fatalf("%s: failed to write video packet %d: %v", test.name, i, err)
+			}
+		}
+		for i := 0; i < frames; i++ {
+			data[0] = byte(i)
+			if err := writer.WritePacket(&Packet{StreamIndex: audioIndex, Codec: StreamTypeAudio, Data: data, Flags: PacketKeyframe}); err != nil {
+				t.Fatalf("%s: failed to write audio packet %d: %v", test.name, i, err)
+			}
+		}
+		if err := writer.Finalize(); err != nil {
+			t.Fatalf("%s: failed to finalize: %v", test.name, err)
+		}
+
+		output := buffer.Bytes()
+		avih := bytes.Index(output, []byte(AVIHChunk))
+		flags := binary.LittleEndian.Uint32(output[avih+8+12:])
+		if (flags&AVIFIsInterleaved != 0) != test.interleaved {
+			t.Errorf("%s: avih flags %#x, interleaved expected %v", test.name, flags, test.interleaved)
+		}
+
+		reader := &Reader{}
+		if err := reader.Open(bytes.NewReader(output), int64(len(output))); err != nil {
+			t.Fatalf("%s: failed to open: %v", test.name, err)
+		}
+		packets := readAllSequential(t, reader)
+		if len(packets) != 2*frames {
+			t.Fatalf("%s: expected %d packets, got %d", test.name, 2*frames, len(packets))
+		}
+
+		if !test.interleaved {
+			if packets[frames/2].StreamIndex != videoIndex {
+				t.Errorf("%s: expected video to be written ahead of the late audio", test.name)
+			}
+			continue
+		}
+
+		// Queued data must not share the caller's buffer
+		for i, packet := range packets {
+			if packet.StreamIndex != i%2 || packet.Data[0] != byte(i/2) {
+				t.Errorf("%s: packet %d: stream %d, payload %d", test.name, i, packet.StreamIndex, packet.Data[0])
+			}
+		}
+	}
+
+	writer := &Writer{}
+	if err := writer.SetMaxInterleave(0); err == nil {
+		t.Error("Expected error for a zero max interleave")
+	}
+}
+
+func TestMuxerRecLists(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	writer.SetRecLists(true)
+	if err := writer.SetMaxRIFFSize(64 * 1024); err != nil {
+		t.Fatalf("SetMaxRIFFSize failed: %v", err)
+	}
+	videoIndex, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25})
+	if err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+	audioIndex, err := writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16})
+	if err != nil {
+		t.Fatalf("Failed to add audio stream: %v", err)
+	}
+
+	const frames = 60
+	for i := 0; i < frames; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: bytes.Repeat([]byte{byte(i)}, 2001), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: audioIndex, Codec: StreamTypeAudio, Data: bytes.Repeat([]byte{byte(i)}, 640), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+	data := buffer.Bytes()
+
+	// One list per frame, each holding the frame and its audio
+	recLists := 0
+	for pos := 0; ; {
+		i := bytes.Index(data[pos:], []byte(RECList))
+		if i < 0 {
+			break
+		}
+		pos += i + 4
+		if string(data[pos-12:pos-8]) != LISTSignature {
+			continue
+		}
+		recLists++
+		if size := binary.LittleEndian.Uint32(data[pos-8:]); size != 4+8+2002+8+640 {
+			t.Errorf("rec list %d: unexpected size %d", recLists, size)
+		}
+		if string(data[pos+2:pos+4]) != "dc" {
+			t.Errorf("rec list %d: does not start with a video frame", recLists)
+		}
+	}
+	if recLists != frames {
+		t.Errorf("Expected %d rec lists, got %d", frames, recLists)
+	}
+
+	// idx1 indexes the lists of the first segment with AVIIF_LIST
+	idx1 := bytes.LastIndex(data, []byte(IDX1Chunk))
+	entries := int(binary.LittleEndian.Uint32(data[idx1+4:])) / 16
+	lists := 0
+	for i := 0; i < entries; i++ {
+		entry := data[idx1+8+i*16:]
+		if string(entry[:4]) == RECList {
+			lists++
+			if binary.LittleEndian.Uint32(entry[4:]) != AVIIFList {
+				t.Errorf("idx1 entry %d: rec list without AVIIF_LIST", i)
+			}
+		}
+	}
+	if lists == 0 || lists*3 != entries {
+		t.Errorf("Expected a rec list entry per frame in idx1, got %d of %d entries", lists, entries)
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.SuggestedBufferSize != 8+4+8+2002+8+640 {
+		t.Errorf("Expected the avih buffer size to fit a rec list, got %d", fileInfo.SuggestedBufferSize)
+	}
+	if !bytes.Contains(data, []byte(AVIXSignature)) {
+		t.Error("Expected the file to span several RIFF segments")
+	}
+
+	packets := readAllSequential(t, reader)
+	indexed, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	if len(packets) != 2*frames || len(indexed) != 2*frames {
+		t.Fatalf("Expected %d packets, got %d sequential and %d indexed", 2*frames, len(packets), len(indexed))
+	}
+	for i, packet := range packets {
+		if packet.Position != indexed[i].Position || packet.Data[0] != byte(i/2) {
+			t.Errorf("Packet %d: at %d, index says %d", i, packet.Position, indexed[i].Position)
+		}
+	}
+}
+
+func TestMuxerBufferSizes(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	videoIndex, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25})
+	if err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+	audioIndex, err := writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16})
+	if err != nil {
+		t.Fatalf("Failed to add audio stream: %v", err)
+	}
+
+	// Three seconds with larger frames during the second one
+	for i := 0; i < 75; i++ {
+		size := 1000
+		if i >= 25 && i < 50 {
+			size = 3000
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: make([]byte, size), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: audioIndex, Codec: StreamTypeAudio, Data: make([]byte, 640), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	fileInfo, _ := reader.GetFileInfo()
+	if expected := 25*(8+3000) + 25*(8+640); fileInfo.MaxBytesPerSec != expected {
+		t.Errorf("Expected MaxBytesPerSec %d, got %d", expected, fileInfo.MaxBytesPerSec)
+	}
+	if fileInfo.SuggestedBufferSize != 3000 {
+		t.Errorf("Expected avih SuggestedBufferSize 3000, got %d", fileInfo.SuggestedBufferSize)
+	}
+
+	streams, _ := reader.GetStreams()
+	if streams[videoIndex].SuggestedBufferSize != 3000 || streams[audioIndex].SuggestedBufferSize != 640 {
+		t.Errorf("Expected strh buffer sizes 3000 and 640, got %d and %d", streams[videoIndex].SuggestedBufferSize, streams[audioIndex].SuggestedBufferSize)
+	}
+}
+
+func TestMuxerStreamHeader(t *testing.T) {
+	headers := []StreamHeader{
+		{
+			Name:     "Main video",
+			Priority: 1,
+			Quality:  9000,
+			Frame:    FrameRect{Left: 0, Top: 10, Right: 64, Bottom: 38},
+		},
+		{
+			Name:          "Commentaire",
+			Flags:         AVISFDisabled,
+			Language:      0x040C, // French
+			InitialFrames: 1,
+			Start:         4,
+			Quality:       0xFFFFFFFF,
+			DriverData:    []byte{1, 2, 3},
+		},
+		{
+			Name:    "Quality 0",
+			Quality: 0, // Kept as is when a header is given
+		},
+	}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	codecs := []Codec{
+		{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 64, Height: 48, FPS: 25},
+		{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16},
+		{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16},
+	}
+	for i, header := range headers {
+		if _, err := writer.AddStreamWithHeader(codecs[i], header); err != nil {
+			t.Fatalf("Failed to add stream %d: %v", i, err)
+		}
+	}
+	if _, err := writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16}); err != nil {
+		t.Fatalf("Failed to add stream 3: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: i, Codec: writer.streams[i].Type, Data: make([]byte, 640), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write packet %d: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	streams, _ := reader.GetStreams()
+	for i, expected := range headers {
+		if !reflect.DeepEqual(streams[i].StreamHeader, expected) {
+			t.Errorf("Stream %d: expected header %+v, got %+v", i, expected, streams[i].StreamHeader)
+		}
+	}
+
+	// Without a header, no strn and the default quality
+	if streams[3].Name != "" || streams[3].Quality != 0xFFFFFFFF {
+		t.Errorf("Stream 3: unexpected default header %+v", streams[3].StreamHeader)
+	}
+
+	if packets := readAllSequential(t, reader); len(packets) != 4 {
+		t.Errorf("Expected 4 packets, got %d", len(packets))
+	}
+}
+
+func TestMuxerMetadata(t *testing.T) {
+	tags := map[string]string{
+		"INAM": "Holiday",
+		"IART": "Someone",
+		"ICRD": "2024-05-01",
+		"ISFT": "avixer",
+	}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25}); err != nil {
+		t.Fatalf("Failed to add stream: %v", err)
+	}
+	for tag, value := range tags {
+		if err := writer.SetMetadata(tag, value); err != nil {
+			t.Fatalf("SetMetadata(%s) failed: %v", tag, err)
+		}
+	}
+	for _, value := range []string{"dropped", ""} {
+		if err := writer.SetMetadata("ICMT", value); err != nil {
+			t.Fatalf("SetMetadata(ICMT, %q) failed: %v", value, err)
+		}
+	}
+	if err := writer.SetMetadata("TITLE", "Holiday"); err == nil {
+		t.Error("Expected error for a tag that is not a chunk ID")
+	}
+
+	if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 100), Flags: PacketKeyframe}); err != nil {
+		t.Fatalf("Failed to write packet: %v", err)
+	}
+	if err := writer.SetMetadata("ICMT", "late"); err == nil {
+		t.Error("Expected error when setting metadata after packets were written")
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	info := bytes.Index(data, []byte(INFOList))
+	if info < 0 || info > bytes.Index(data, []byte(MOVIList)) {
+		t.Errorf("Expected the INFO list ahead of movi")
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	fileInfo, _ := reader.GetFileInfo()
+	if !reflect.DeepEqual(fileInfo.Metadata, tags) {
+		t.Errorf("Expected tags %v, got %v", tags, fileInfo.Metadata)
+	}
+
+	if packets := readAllSequential(t, reader); len(packets) != 1 {
+		t.Errorf("Expected 1 packet, got %d", len(packets))
+	}
+}
+
+func TestMuxerPalette(t *testing.T) {
+	palette := make([]uint32, 16)
+	for i := range palette {
+		palette[i] = uint32(i) * 0x111111
+	}
+	change := PaletteChange{FirstEntry: 4, Entries: []uint32{0xFF0000, 0x00FF00}}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "RLE8", FourCC: [4]byte{1, 0, 0, 0}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25, BitCount: 8, Palette: palette}); err != nil {
+		t.Fatalf("Failed to add stream: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25, Palette: make([]uint32, 257)}); err == nil {
+		t.Error("Expected error for a palette of more than 256 entries")
+	}
+	if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 64), PaletteChanges: []PaletteChange{{FirstEntry: 255, Entries: []uint32{0, 0}}}}); err == nil {
+		t.Error("Expected error for a palette change past entry 255")
+	}
+
+	for i := 0; i < 3; i++ {
+		packet := &Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 64), Flags: PacketKeyframe}
+		if i == 1 {
+			packet.PaletteChanges = []PaletteChange{change}
+		}
+		if err := writer.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket %d failed: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	if !bytes.Contains(data, []byte("00pc")) {
+		t.Fatal("Expected a 00pc chunk")
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	streams, _ := reader.GetStreams()
+	if !reflect.DeepEqual(streams[0].Codec.Palette, palette) || len(streams[0].Codec.ExtraData) != 0 {
+		t.Errorf("Expected palette %v without extra data, got %v and %v", palette, streams[0].Codec.Palette, streams[0].Codec.ExtraData)
+	}
+	if streams[0].Flags&AVISFVideoPalChanges == 0 {
+		t.Error("Expected the palette changes stream flag")
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 packets, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		var expected []PaletteChange
+		if i == 1 {
+			expected = []PaletteChange{change}
+		}
+		if !reflect.DeepEqual(packet.PaletteChanges, expected) {
+			t.Errorf("Packet %d: expected palette changes %v, got %v", i, expected, packet.PaletteChanges)
+		}
+	}
+
+	indexed, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	if len(indexed) != 3 || !reflect.DeepEqual(indexed[1].PaletteChanges, []PaletteChange{change}) {
+		t.Errorf("Expected the palette change on the second indexed packet, got %+v", indexed)
+	}
+
+	// Seeking past the frame still hands the change to the next frame read
+	if err := reader.SeekWithMode(80*time.Millisecond, SeekExact); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	packet, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket after seek failed: %v", err)
+	}
+	if !reflect.DeepEqual(packet.PaletteChanges, []PaletteChange{change}) {
+		t.Errorf("Expected the palette change after seeking, got %v", packet.PaletteChanges)
+	}
+}
+
+func TestMuxerDataStreams(t *testing.T) {
+	var strh bytes.Buffer
+	binary.Write(&strh, binary.LittleEndian, AVIStreamHeader{Type: [4]byte{'m', 'i', 'd', 's'}, Scale: 1, Rate: 25, Length: 2})
+	rawHeader := strh.Bytes()[:48] // without the frame rectangle
+	format := []byte{1, 2, 3, 4, 5}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25}); err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Type: StreamTypeData}); err == nil {
+		t.Error("Expected error for a data stream without a stream header")
+	}
+	if _, err := writer.AddStream(Codec{Type: StreamTypeData, RawHeader: rawHeader, ExtraData: format}); err != nil {
+		t.Fatalf("Failed to add data stream: %v", err)
+	}
+	if err := writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeData, Data: []byte("MThd")}); err == nil {
+		t.Error("Expected error for a data packet without a chunk type")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 100), Flags: PacketKeyframe}); err != nil {
+			t.Fatalf("Failed to write video packet: %v", err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeData, Data: []byte{0x90, 0x3C, byte(i)}, ChunkType: "md"}); err != nil {
+			t.Fatalf("Failed to write data packet: %v", err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	if !bytes.Contains(data, append([]byte("strh\x30\x00\x00\x00"), rawHeader...)) || !bytes.Contains(data, []byte("01md")) {
+		t.Fatal("Expected the raw stream header and 01md chunks")
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.DataStreams != 1 {
+		t.Errorf("Expected 1 data stream, got %d", fileInfo.DataStreams)
+	}
+	streams, _ := reader.GetStreams()
+	if codec := streams[1].Codec; streams[1].Type != StreamTypeData || !bytes.Equal(codec.RawHeader, rawHeader) || !bytes.Equal(codec.ExtraData, format) {
+		t.Errorf("Unexpected data stream %+v", streams[1])
+	}
+
+	packets := readAllSequential(t, reader)
+	indexed, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	if len(packets) != 4 || len(indexed) != 4 {
+		t.Fatalf("Expected 4 packets, got %d and %d indexed", len(packets), len(indexed))
+	}
+	if packet := packets[3]; packet.Codec != StreamTypeData || packet.ChunkType != "md" || !bytes.Equal(packet.Data, []byte{0x90, 0x3C, 1}) {
+		t.Errorf("Unexpected data packet %+v", packet)
+	}
+	if indexed[3].ChunkType != "md" || indexed[3].PTSTime != 40*time.Millisecond {
+		t.Errorf("Unexpected indexed data packet %+v", indexed[3])
+	}
+
+	// Written back as read
+	remuxed := NewSeekableBuffer()
+	writer = &Writer{}
+	if err := writer.Create(remuxed); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	for _, stream := range streams {
+		if _, err := writer.AddStreamWithHeader(stream.Codec, stream.StreamHeader); err != nil {
+			t.Fatalf("Failed to add stream %d: %v", stream.Index, err)
+		}
+	}
+	for _, packet := range packets {
+		if err := writer.WritePacket(packet); err != nil {
+			t.Fatalf("Failed to write packet: %v", err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+	if !bytes.Contains(remuxed.Bytes(), append([]byte("strh\x30\x00\x00\x00"), rawHeader...)) || !bytes.Contains(remuxed.Bytes(), append([]byte("strf\x05\x00\x00\x00"), format...)) {
+		t.Error("Expected the raw stream header and format to be written back")
+	}
+}
+
+func TestMuxerStartOffsets(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25}); err != nil {
+		t.Fatalf("Failed to add video stream: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16}); err != nil {
+		t.Fatalf("Failed to add audio stream: %v", err)
+	}
+	if err := writer.SetAudioPreRoll(100 * time.Millisecond); err != nil {
+		t.Fatalf("SetAudioPreRoll failed: %v", err)
+	}
+
+	// Audio starts 200 ms in and is written 3 frames ahead of the video
+	for i := 0; i < 10; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 100), Flags: PacketKeyframe, PTSTime: time.Duration(i) * 40 * time.Millisecond}); err != nil {
+			t.Fatalf("Failed to write video packet %d: %v", i, err)
+		}
+		if err := writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeAudio, Data: make([]byte, 640), PTSTime: 200*time.Millisecond + time.Duration(i)*40*time.Millisecond}); err != nil {
+			t.Fatalf("Failed to write audio packet %d: %v", i, err)
+		}
+	}
+	if err := writer.SetAudioPreRoll(0); err == nil {
+		t.Error("Expected error setting the pre-roll after the first packet")
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	streams, _ := reader.GetStreams()
+	if streams[0].Start != 0 || streams[0].StartTime != 0 || streams[0].PreRoll != 0 {
+		t.Errorf("Expected the video to start at zero, got %+v", streams[0])
+	}
+	if audio := streams[1]; audio.Start != 1600 || audio.StartTime != 200*time.Millisecond || audio.InitialFrames != 3 || audio.PreRoll != 120*time.Millisecond {
+		t.Errorf("Expected audio starting at 200 ms with a 120 ms pre-roll, got start %d (%v), initial frames %d (%v)", audio.Start, audio.StartTime, audio.InitialFrames, audio.PreRoll)
+	}
+
+	packets := readAllSequential(t, reader)
+	if len(packets) != 20 {
+		t.Fatalf("Expected 20 packets, got %d", len(packets))
+	}
+	if packets[2].StreamIndex != 1 {
+		t.Errorf("Expected the first audio chunk after 2 frames, got stream %d", packets[2].StreamIndex)
+	}
+	if audio := packets[2]; audio.PTS != 1600 || audio.DTS != 1600 || audio.PTSTime != 200*time.Millisecond {
+		t.Errorf("Expected the first audio packet at 200 ms, got PTS %d (%v)", audio.PTS, audio.PTSTime)
+	}
+
+	indexed, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	for i, packet := range indexed {
+		if packet.PTSTime != packets[i].PTSTime {
+			t.Errorf("Packet %d: indexed at %v, read at %v", i, packet.PTSTime, packets[i].PTSTime)
+		}
+	}
+}
+
+func TestMuxerDataChunkTypes(t *testing.T) {
+	header := make([]byte, 56)
+	copy(header, "mids")
+
+	// Mixed chunk types get an ix## each in every segment
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if err := writer.SetMaxRIFFSize(2048); err != nil {
+		t.Fatalf("SetMaxRIFFSize failed: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Type: StreamTypeData, RawHeader: header}); err != nil {
+		t.Fatalf("Failed to add stream: %v", err)
+	}
+	types := []string{"md", "tc", "tc", "md", "xx"}
+	for i := 0; i < 40; i++ {
+		if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeData, Data: make([]byte, 100), ChunkType: types[i%len(types)]}); err != nil {
+			t.Fatalf("Failed to write packet %d: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+	if !bytes.Contains(buffer.Bytes(), []byte("AVIX")) {
+		t.Fatal("Expected an AVIX segment")
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(buffer.Bytes()), int64(buffer.Len())); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	if len(packets) != 40 {
+		t.Fatalf("Expected 40 packets, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		if packet.ChunkType != types[i%len(types)] {
+			t.Errorf("Packet %d: expected chunk type %q, got %q", i, types[i%len(types)], packet.ChunkType)
+		}
+	}
+
+	// A reused writer does not keep the chunk types of the previous file
+	buffer = NewSeekableBuffer()
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Type: StreamTypeData, RawHeader: header}); err != nil {
+		t.Fatalf("Failed to add stream: %v", err)
+	}
+	if err := writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeData, Data: make([]byte, 10), ChunkType: "tc"}); err != nil {
+		t.Fatalf("Failed to write packet: %v", err)
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+	if bytes.Contains(buffer.Bytes(), []byte("00md")) {
+		t.Error("Expected no 00md chunk ID in the second file")
+	}
+}
+
+func TestMuxerPaletteOpenDML(t *testing.T) {
+	change := PaletteChange{FirstEntry: 1, Entries: []uint32{0x123456}}
+
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	if err := writer.Create(buffer); err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	if err := writer.SetMaxRIFFSize(2048); err != nil {
+		t.Fatalf("SetMaxRIFFSize failed: %v", err)
+	}
+	if _, err := writer.AddStream(Codec{Name: "RLE8", FourCC: [4]byte{1, 0, 0, 0}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25, BitCount: 8, Palette: make([]uint32, 4)}); err != nil {
+		t.Fatalf("Failed to add stream: %v", err)
+	}
+	for i := 0; i < 60; i++ {
+		packet := &Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 64), Flags: PacketKeyframe}
+		if i == 50 {
+			packet.PaletteChanges = []PaletteChange{change}
+		}
+		if err := writer.WritePacket(packet); err != nil {
+			t.Fatalf("WritePacket %d failed: %v", i, err)
+		}
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	// The change is past idx1, in an AVIX segment
+	data := buffer.Bytes()
+	if avix, pc := bytes.LastIndex(data, []byte(AVIXSignature)), bytes.Index(data, []byte("00pc")); avix < 0 || pc < avix {
+		t.Fatalf("Expected the 00pc chunk in an AVIX segment")
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets failed: %v", err)
+	}
+	if len(packets) != 60 {
+		t.Fatalf("Expected 60 packets, got %d", len(packets))
+	}
+	for i, packet := range packets {
+		var expected []PaletteChange
+		if i == 50 {
+			expected = []PaletteChange{change}
+		}
+		if !reflect.DeepEqual(packet.PaletteChanges, expected) {
+			t.Errorf("Packet %d: expected palette changes %v, got %v", i, expected, packet.PaletteChanges)
+		}
+	}
+
+	// Seeking past the change still applies it to the next frame
+	if err := reader.SeekWithMode(51*40*time.Millisecond, SeekExact); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	packet, err := reader.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if packet.PTSTime != 51*40*time.Millisecond || !reflect.DeepEqual(packet.PaletteChanges, []PaletteChange{change}) {
+		t.Errorf("Expected frame 51 with the palette change, got %v with %v", packet.PTSTime, packet.PaletteChanges)
+	}
+}
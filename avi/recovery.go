@@ -0,0 +1,330 @@
+package avi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// RecoveryReport describes the damage found by Reader.Recover
+type RecoveryReport struct {
+	RecoveredChunks int   // Stream chunks found and indexed
+	SkippedBytes    int64 // Bytes that could not be parsed as chunks
+	Resyncs         int   // Damaged regions skipped over
+	Truncated       bool  // The last chunk runs past the end of the file
+}
+
+// scanKind classifies what was found at a scan position
+type scanKind int
+
+const (
+	scanGarbage   scanKind = iota
+	scanData               // Stream data chunk
+	scanStructure          // LIST, RIFF, JUNK or index chunk
+	scanTruncated          // Stream data chunk cut off by the end of the file
+	scanRecList            // LIST rec, indexed and descended into
+)
+
+// scanWindowSize is the amount read ahead while scanning for chunk headers
+const scanWindowSize = 64 * 1024
+
+// Recover rebuilds the index by scanning the movi data for chunk headers,
+// for files whose idx1 is missing or whose capture was cut off.
+//
+// The scan walks chunk by chunk while headers are valid. On anything else it
+// moves forward byte by byte until a stream chunk header whose size fits in
+// the file and which is followed by another plausible header is found.
+// Keyframes are inferred from the payload for MPEG-4 and H.264 video, other
+// chunks are taken as keyframes. A last chunk cut off by the end of the file
+// is indexed and returned marked as PacketCorrupt. The rebuilt index replaces
+// the parsed one, and ReadPacket follows it from the start of the movi data
+// to step over damaged regions.
+func (r *Reader) Recover() (*RecoveryReport, error) {
+	if r.r == nil || r.fileInfo == nil {
+		return nil, &AVIError{Op: "recover", Err: fmt.Errorf("file not opened")}
+	}
+
+	if len(r.streams) == 0 {
+		return nil, &AVIError{Op: "recover", Err: fmt.Errorf("no streams found")}
+	}
+
+	// Without a movi list, scan everything after the RIFF header
+	start := int64(12)
+	if len(r.segments) > 0 {
+		start = r.segments[0].start + 4
+	}
+
+	window := &scanWindow{r: r.r, size: r.fileSize, buf: make([]byte, scanWindowSize)}
+	report := &RecoveryReport{}
+	var index []indexRecord
+
+	pos := start
+	inSync := true
+	for pos+8 <= r.fileSize {
+		kind, next, err := r.scanChunk(window, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		// Right after garbage a header may match by chance, so also
+		// require the following one to be plausible
+		if kind == scanTruncated && !inSync {
+			kind = scanGarbage
+		}
+		if kind == scanData && !inSync {
+			nextKind, _, err := r.scanChunk(window, next)
+			if err != nil {
+				return nil, err
+			}
+			if nextKind == scanGarbage && next+8 <= r.fileSize {
+				kind = scanGarbage
+			}
+		}
+
+		switch kind {
+		case scanData, scanTruncated:
+			header, err := window.peek(pos, 8)
+			if err != nil {
+				return nil, &AVIError{Op: "recover", Err: err}
+			}
+			chunk := ReadChunkHeader(header)
+
+			var flags uint32
+			if _, twoCC, _ := ParseChunkID(chunk.ID); twoCC == "pc" {
+				flags = AVIIFNoTime
+			} else {
+				// Only what is left of a truncated chunk can be looked at
+				probe := chunk
+				if available := r.fileSize - pos - 8; int64(probe.Size) > available {
+					probe.Size = uint32(available)
+				}
+				keyframe, err := r.inferKeyframe(window, probe, pos)
+				if err != nil {
+					return nil, err
+				}
+				if keyframe {
+					flags = AVIIFKeyframe
+				}
+			}
+
+			index = append(index, indexRecord{
+				chunkID:  chunk.ID,
+				flags:    flags,
+				position: pos,
+				size:     chunk.Size,
+			})
+			report.RecoveredChunks++
+			inSync = true
+			pos = next
+			if kind == scanTruncated {
+				report.Truncated = true
+				pos = r.fileSize
+			}
+		case scanRecList:
+			header, err := window.peek(pos, 8)
+			if err != nil {
+				return nil, &AVIError{Op: "recover", Err: err}
+			}
+			chunk := ReadChunkHeader(header)
+
+			index = append(index, indexRecord{
+				chunkID:  StringToChunkID(RECList),
+				flags:    AVIIFList,
+				position: pos,
+				size:     chunk.Size,
+			})
+			inSync = true
+			pos = next
+		case scanStructure:
+			inSync = true
+			pos = next
+		default:
+			if inSync {
+				report.Resyncs++
+			}
+			inSync = false
+			report.SkippedBytes++
+			pos++
+		}
+	}
+
+	if pos < r.fileSize {
+		// Trailing bytes too short to hold a chunk header
+		report.SkippedBytes += r.fileSize - pos
+	}
+
+	r.index = index
+	r.indexByPosition = index
+	r.recovered = true
+
+	// Let ReadPacket reach chunks past a damaged movi list size
+	if len(r.segments) == 0 {
+		r.segments = []moviSegment{{start: start - 4, end: r.fileSize}}
+	}
+	r.segments[len(r.segments)-1].end = r.fileSize
+
+	// Timestamps and palette changes of what was read so far came from
+	// the old index
+	r.resetPlayback()
+
+	return report, nil
+}
+
+// scanChunk classifies the chunk header at pos and returns where the next
+// one would start
+func (r *Reader) scanChunk(window *scanWindow, pos int64) (scanKind, int64, error) {
+	data, err := window.peek(pos, 8)
+	if err != nil {
+		return scanGarbage, 0, &AVIError{Op: "recover", Err: err}
+	}
+	if data == nil {
+		return scanGarbage, 0, nil
+	}
+
+	header := ReadChunkHeader(data)
+	end := pos + 8 + int64(AlignSize(header.Size))
+
+	if streamIndex, twoCC, ok := ParseChunkID(header.ID); ok {
+		codecType, known := r.chunkStreamType(streamIndex, twoCC)
+		if twoCC == "pc" && codecType != StreamTypeData {
+			codecType, known = StreamTypeVideo, true // Palette change
+		}
+		if !known || streamIndex >= len(r.streams) || r.streams[streamIndex].Type != codecType {
+			return scanGarbage, 0, nil
+		}
+		if pos+8+int64(header.Size) > r.fileSize {
+			return scanTruncated, 0, nil
+		}
+		return scanData, end, nil
+	}
+
+	id := ChunkIDToString(header.ID)
+	switch {
+	case id == LISTSignature || id == RIFFSignature:
+		listType, err := window.peek(pos+8, 4)
+		if err != nil {
+			return scanGarbage, 0, &AVIError{Op: "recover", Err: err}
+		}
+		switch string(listType) {
+		case RECList:
+			return scanRecList, pos + 12, nil
+		case MOVIList, AVIXSignature:
+			// Descend into the list
+			return scanStructure, pos + 12, nil
+		case HDRLList, ODMLList, INFOList:
+			if end <= r.fileSize {
+				return scanStructure, end, nil
+			}
+		}
+	case id == JUNKChunk || id == IDX1Chunk || (header.ID[0] == 'i' && header.ID[1] == 'x'):
+		if end <= r.fileSize {
+			return scanStructure, end, nil
+		}
+	}
+
+	return scanGarbage, 0, nil
+}
+
+// keyframeProbeSize is how much of a video payload is looked at to tell
+// whether it is a keyframe
+const keyframeProbeSize = 256
+
+// inferKeyframe guesses whether a recovered chunk is a keyframe. Audio and
+// uncompressed video always are; compressed video is inspected for MPEG-4
+// I-VOPs and H.264 IDR slices, anything else is assumed to be intra coded.
+func (r *Reader) inferKeyframe(window *scanWindow, header ChunkHeader, pos int64) (bool, error) {
+	streamIndex, twoCC, _ := ParseChunkID(header.ID)
+	if twoCC != "dc" {
+		return true, nil
+	}
+
+	size := int(header.Size)
+	if size > keyframeProbeSize {
+		size = keyframeProbeSize
+	}
+
+	payload, err := window.peek(pos+8, size)
+	if err != nil {
+		return false, &AVIError{Op: "recover", Err: err}
+	}
+
+	switch string(bytes.ToUpper(r.streams[streamIndex].Codec.FourCC[:])) {
+	case CODECXVID, CODECDIVX, CODECMP4V, "DX50", "FMP4", "M4S2":
+		return isMPEG4Keyframe(payload), nil
+	case CODECH264, "AVC1", "X264":
+		return isH264Keyframe(payload), nil
+	}
+
+	return true, nil
+}
+
+// isMPEG4Keyframe reports whether an MPEG-4 Part 2 frame holds an I-VOP
+func isMPEG4Keyframe(payload []byte) bool {
+	vop := bytes.Index(payload, []byte{0x00, 0x00, 0x01, 0xB6})
+	if vop < 0 || vop+4 >= len(payload) {
+		return false
+	}
+	// vop_coding_type is the top two bits, 0 for intra
+	return payload[vop+4]>>6 == 0
+}
+
+// isH264Keyframe reports whether an Annex B H.264 frame holds an IDR slice
+func isH264Keyframe(payload []byte) bool {
+	for i := 0; i+3 < len(payload); i++ {
+		if payload[i] != 0 || payload[i+1] != 0 || payload[i+2] != 1 {
+			continue
+		}
+		switch payload[i+3] & 0x1F {
+		case 5: // IDR slice
+			return true
+		case 1: // Non-IDR slice
+			return false
+		}
+	}
+	return false
+}
+
+// scanWindow buffers the reads of the region being scanned
+type scanWindow struct {
+	r    io.ReadSeeker
+	size int64
+	buf  []byte
+	off  int64
+	n    int
+}
+
+// peek returns length bytes at pos, or nil when they run past the end of
+// the file. The slice is only valid until the next call.
+func (w *scanWindow) peek(pos int64, length int) ([]byte, error) {
+	if pos < 0 || pos+int64(length) > w.size {
+		return nil, nil
+	}
+
+	if pos < w.off || pos+int64(length) > w.off+int64(w.n) {
+		if _, err := w.r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(w.r, w.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		w.off, w.n = pos, n
+		if length > n {
+			return nil, nil
+		}
+	}
+
+	return w.buf[pos-w.off : pos-w.off+int64(length)], nil
+}
+
+// nextIndexed returns the first index entry at or after pos
+func (r *Reader) nextIndexed(pos int64) (indexRecord, bool) {
+	i := sort.Search(len(r.indexByPosition), func(i int) bool {
+		return r.indexByPosition[i].position >= pos
+	})
+	if i == len(r.indexByPosition) {
+		return indexRecord{}, false
+	}
+	return r.indexByPosition[i], true
+}
@@ -0,0 +1,170 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestRecoverDamagedFile(t *testing.T) {
+	data := stripIndexes(buildTestAVI(t, 10))
+
+	// Put garbage between the 3rd and 4th chunks, including a chunk header
+	// with an impossible size and one that is not followed by a valid chunk
+	movi := bytes.Index(data, []byte(MOVIList))
+	pos := movi + 4
+	for i := 0; i < 3; i++ {
+		pos += 8 + int(AlignSize(binary.LittleEndian.Uint32(data[pos+4:])))
+	}
+
+	garbage := bytes.Repeat([]byte{0xAA}, 13)
+	garbage = append(garbage, WriteChunkHeader(ChunkHeader{ID: MakeChunkID(0, "dc"), Size: 0xFFFFFF00})...)
+	garbage = append(garbage, WriteChunkHeader(ChunkHeader{ID: MakeChunkID(1, "wb"), Size: 4})...)
+	garbage = append(garbage, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA)
+
+	var damaged []byte
+	damaged = append(damaged, data[:pos]...)
+	damaged = append(damaged, garbage...)
+	damaged = append(damaged, data[pos:]...)
+
+	// Cut the capture off in the middle of the last audio chunk, dropping
+	// the standard indexes that follow it
+	end := bytes.Index(damaged, []byte("ix00"))
+	damaged = damaged[:end-100]
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(damaged), int64(len(damaged))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	if _, err := reader.ReadAllPackets(); err == nil {
+		t.Fatal("Expected ReadAllPackets to fail without an index")
+	}
+
+	// Reading starts over once the index is rebuilt
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadPacket(); err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+	}
+
+	report, err := reader.Recover()
+	if err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	if report.RecoveredChunks != 20 {
+		t.Errorf("Expected 20 recovered chunks, got %d", report.RecoveredChunks)
+	}
+
+	if report.Resyncs != 1 {
+		t.Errorf("Expected 1 resync, got %d", report.Resyncs)
+	}
+
+	if !report.Truncated {
+		t.Error("Expected the cut off last chunk to be reported")
+	}
+
+	if report.SkippedBytes != int64(len(garbage)) {
+		t.Errorf("Expected %d skipped bytes, got %d", len(garbage), report.SkippedBytes)
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets after recovery failed: %v", err)
+	}
+
+	if len(packets) != 20 {
+		t.Fatalf("Expected 20 packets, got %d", len(packets))
+	}
+
+	sequential := readAllSequential(t, reader)
+	if len(sequential) != len(packets) {
+		t.Fatalf("Expected ReadPacket to follow the recovered index, got %d packets", len(sequential))
+	}
+
+	for i, packet := range sequential {
+		if packet.StreamIndex != i%2 || packet.Data[0] != byte(i/2) || packet.Position != packets[i].Position || packet.PTSTime != packets[i].PTSTime {
+			t.Errorf("Packet %d: got stream %d payload %d at %d (%v)", i, packet.StreamIndex, packet.Data[0], packet.Position, packet.PTSTime)
+		}
+	}
+
+	// The cut off chunk is returned with what is left of it by both paths
+	last, indexed := sequential[19], packets[19]
+	if last.Flags&PacketCorrupt == 0 || last.Size != 640-100 || len(last.Data) != 640-100 {
+		t.Errorf("Expected the last chunk marked corrupt with %d bytes, got flags %v and %d bytes", 640-100, last.Flags, len(last.Data))
+	}
+	if indexed.Flags&PacketCorrupt == 0 || indexed.Size != last.Size {
+		t.Errorf("Expected the indexed last chunk marked corrupt with %d bytes, got flags %v and %d bytes", last.Size, indexed.Flags, indexed.Size)
+	}
+	if data, err := reader.ReadPacketData(&indexed); err != nil || len(data) != last.Size {
+		t.Errorf("Expected ReadPacketData to return %d bytes of the last chunk, got %d (%v)", last.Size, len(data), err)
+	}
+}
+
+func TestRecoverUnfinishedCapture(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	muxer := NewMuxer()
+	muxer.Create(buffer)
+	videoIndex, _ := muxer.AddStream(Codec{Name: "H264", FourCC: [4]byte{'H', '2', '6', '4'}, Type: StreamTypeVideo, Width: 64, Height: 48, FPS: 25.0})
+
+	idr := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x65, 0x88}
+	nonIDR := []byte{0, 0, 0, 1, 0x41, 0x9A}
+	for i := 0; i < 6; i++ {
+		data := nonIDR
+		if i%3 == 0 {
+			data = idr
+		}
+		if err := muxer.WritePacket(&Packet{StreamIndex: videoIndex, Codec: StreamTypeVideo, Data: data}); err != nil {
+			t.Fatalf("Failed to write packet %d: %v", i, err)
+		}
+	}
+
+	// Never finalized: the movi size is still zero and there is no index
+	data := buffer.Bytes()
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	report, err := reader.Recover()
+	if err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	if report.RecoveredChunks != 6 || report.SkippedBytes != 0 {
+		t.Errorf("Expected 6 chunks and no damage, got %+v", report)
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets after recovery failed: %v", err)
+	}
+
+	for i, packet := range packets {
+		if (packet.Flags&PacketKeyframe != 0) != (i%3 == 0) {
+			t.Errorf("Packet %d: inferred flags %#x", i, packet.Flags)
+		}
+	}
+}
+
+func TestKeyframeInference(t *testing.T) {
+	tests := []struct {
+		name     string
+		detect   func([]byte) bool
+		payload  []byte
+		keyframe bool
+	}{
+		{"mpeg4 i-vop", isMPEG4Keyframe, []byte{0, 0, 1, 0xB0, 0x01, 0, 0, 1, 0xB6, 0x10}, true},
+		{"mpeg4 p-vop", isMPEG4Keyframe, []byte{0, 0, 1, 0xB6, 0x50}, false},
+		{"mpeg4 no vop", isMPEG4Keyframe, []byte{1, 2, 3, 4}, false},
+		{"h264 idr", isH264Keyframe, []byte{0, 0, 0, 1, 0x67, 0, 0, 1, 0x68, 0, 0, 1, 0x65}, true},
+		{"h264 non-idr", isH264Keyframe, []byte{0, 0, 0, 1, 0x09, 0xF0, 0, 0, 1, 0x41}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.detect(test.payload); got != test.keyframe {
+			t.Errorf("%s: got keyframe %v, expected %v", test.name, got, test.keyframe)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RepairChange is a header field fixed by a repair
+type RepairChange struct {
+	Field  string // Description of the field, e.g. "RIFF size"
+	Offset int64  // Position of the field in the file
+	Old    uint32 // Value found in the file
+	New    uint32 // Value written by the repair
+}
+
+// RepairPlan lists the fixes needed to make a damaged AVI file consistent
+type RepairPlan struct {
+	Recovery        *RecoveryReport // Result of the chunk scan
+	Changes         []RepairChange  // Header fields to patch
+	IndexRebuilt    bool            // Whether idx1 is rewritten
+	IndexOffset     int64           // Position of the idx1 chunk
+	OldIndexEntries int             // Complete idx1 entries found in the file
+	IndexEntries    int             // idx1 entries after the repair
+	OriginalSize    int64           // File size before the repair
+	FileSize        int64           // File size after the repair
+	DiscardedOffset int64           // Start of the data after the movi list and old idx1
+	DiscardedBytes  int64           // Size of that data, cut off by the repair
+	TruncatedOffset int64           // Start of the movi chunk cut off by the end of the file
+	TruncatedBytes  int64           // What is left of that chunk, overwritten by idx1
+
+	index []byte // Rebuilt idx1 chunk, header included
+}
+
+// headerOffsets holds the positions of the header chunk payloads a repair
+// may patch, -1 when absent
+type headerOffsets struct {
+	avih int64
+	strh []int64
+	indx []int64
+	dmlh int64
+}
+
+// PlanRepair scans a damaged AVI file and works out the changes that make
+// its RIFF and movi sizes, frame counts, stream lengths and idx1 match the
+// chunks actually present. Nothing is written. The file is cut after the
+// movi data to append idx1: a last movi chunk cut off by the end of the file
+// is reported as truncated, and whatever followed the movi list and the old
+// idx1 as discarded. Only single RIFF segment files are supported.
+func PlanRepair(reader io.ReadSeeker, size int64) (*RepairPlan, error) {
+	r := &Reader{}
+	if err := r.Open(reader, size); err != nil {
+		return nil, err
+	}
+
+	if len(r.segments) == 0 {
+		return nil, &AVIError{Op: "repair", Err: fmt.Errorf("no movi list found")}
+	}
+
+	if len(r.segments) > 1 {
+		return nil, &AVIError{Op: "repair", Err: fmt.Errorf("files with %d RIFF segments are not supported", len(r.segments))}
+	}
+
+	// Keep the keyframe flags of chunks the damaged index still knows about
+	original := r.index
+	flags := make(map[int64]uint32, len(original))
+	for _, record := range original {
+		flags[record.position] = record.flags
+	}
+
+	recovery, err := r.Recover()
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := size
+	records := make([]indexRecord, 0, len(r.index))
+	for _, record := range r.index {
+		if record.flags&AVIIFList == 0 && record.position+8+int64(record.size) > size {
+			truncated = record.position // Cut off by the end of the file, overwritten by idx1
+			continue
+		}
+		if f, ok := flags[record.position]; ok {
+			record.flags = f
+		}
+		records = append(records, record)
+	}
+
+	// A capture cut off inside a rec list leaves its size unpatched, so
+	// take it from the chunks found up to the next list
+	for i, record := range records {
+		if record.flags&AVIIFList == 0 {
+			continue
+		}
+		end := record.position + 12
+		for _, chunk := range records[i+1:] {
+			if chunk.flags&AVIIFList != 0 {
+				break
+			}
+			end = chunk.position + 8 + int64(AlignSize(chunk.size))
+		}
+		records[i].size = uint32(end - record.position - 8)
+	}
+
+	offsets, err := locateHeaders(r.r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	moviOffset := r.segments[0].start
+	dataEnd, err := moviDataEnd(r.r, size, moviOffset, records)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &RepairPlan{
+		Recovery:     recovery,
+		IndexOffset:  dataEnd,
+		IndexEntries: len(records),
+		OriginalSize: size,
+	}
+
+	// The idx1 chunk is expected right after the movi list
+	var index bytes.Buffer
+	binary.Write(&index, binary.LittleEndian, ChunkHeader{ID: StringToChunkID(IDX1Chunk), Size: uint32(len(records) * 16)})
+	for _, record := range records {
+		binary.Write(&index, binary.LittleEndian, IndexEntry{
+			ChunkID: record.chunkID,
+			Flags:   record.flags,
+			Offset:  uint32(record.position - moviOffset), // Relative to the movi signature
+			Size:    record.size,
+		})
+	}
+
+	existing, err := readUint32s(r.r, size, dataEnd, 2)
+	if err != nil {
+		return nil, err
+	}
+	plan.DiscardedOffset = dataEnd
+	if existing != nil && ChunkIDToString(idOf(existing[0])) == IDX1Chunk {
+		plan.DiscardedOffset = dataEnd + 8 + int64(AlignSize(existing[1]))
+		if plan.DiscardedOffset > size {
+			plan.DiscardedOffset = size
+		}
+
+		available := size - dataEnd - 8
+		if int64(existing[1]) < available {
+			available = int64(existing[1])
+		}
+		plan.OldIndexEntries = int(available / 16)
+
+		current := make([]byte, index.Len())
+		if int64(existing[1]) == int64(len(records)*16) && available == int64(existing[1]) {
+			if _, err := r.r.Seek(dataEnd, io.SeekStart); err != nil {
+				return nil, &AVIError{Op: "seek to idx1", Err: err}
+			}
+			if _, err := io.ReadFull(r.r, current); err != nil {
+				return nil, &AVIError{Op: "read idx1", Err: err}
+			}
+		}
+		plan.IndexRebuilt = !sameIndex(current, index.Bytes())
+	} else {
+		plan.IndexRebuilt = true
+	}
+
+	if plan.IndexRebuilt {
+		plan.index = index.Bytes()
+	}
+	plan.FileSize = dataEnd + int64(index.Len())
+	if truncated < plan.DiscardedOffset {
+		truncated = plan.DiscardedOffset
+	}
+	if truncated < size {
+		plan.TruncatedOffset = truncated
+		plan.TruncatedBytes = size - truncated
+	}
+	plan.DiscardedBytes = truncated - plan.DiscardedOffset
+
+	// Count what each stream really holds
+	chunks := make([]uint32, len(r.streams))
+	totalBytes := make([]int64, len(r.streams))
+	for _, record := range records {
+		streamIndex, twoCC, ok := ParseChunkID(record.chunkID)
+		if _, known := r.chunkStreamType(streamIndex, twoCC); !ok || !known {
+			continue // rec list or palette change
+		}
+		chunks[streamIndex]++
+		totalBytes[streamIndex] += int64(record.size)
+	}
+
+	videoFrames := uint32(0)
+	hasVideo := false
+	for i, stream := range r.streams {
+		if stream.Type == StreamTypeVideo {
+			videoFrames = chunks[i]
+			hasVideo = true
+			break
+		}
+	}
+
+	if err := plan.check(r.r, size, "RIFF size", 4, uint32(plan.FileSize-8)); err != nil {
+		return nil, err
+	}
+
+	if err := plan.check(r.r, size, "movi LIST size", moviOffset-4, uint32(dataEnd-moviOffset)); err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if record.flags&AVIIFList == 0 {
+			continue
+		}
+		if err := plan.check(r.r, size, "rec LIST size", record.position+4, record.size); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasVideo && offsets.avih >= 0 {
+		if err := plan.check(r.r, size, "avih TotalFrames", offsets.avih+16, videoFrames); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasVideo && offsets.dmlh >= 0 {
+		if err := plan.check(r.r, size, "dmlh TotalFrames", offsets.dmlh, videoFrames); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, offset := range offsets.strh {
+		if offset < 0 || i >= len(r.streams) {
+			continue
+		}
+
+		// Length counts samples for fixed size samples, chunks otherwise
+		values, err := readUint32s(r.r, size, offset+44, 1)
+		if err != nil {
+			return nil, err
+		}
+		length := chunks[i]
+		if values != nil && values[0] > 0 {
+			length = uint32(totalBytes[i] / int64(values[0]))
+		}
+
+		if err := plan.check(r.r, size, fmt.Sprintf("stream %d strh Length", i), offset+32, length); err != nil {
+			return nil, err
+		}
+	}
+
+	// Readers prefer the OpenDML indexes over idx1, so they must go when
+	// they no longer match the data
+	if len(r.superIndexes) > 0 && !samePositions(original, streamRecords(records)) {
+		for i, offset := range offsets.indx {
+			if offset < 0 {
+				continue
+			}
+			header, err := readUint32s(r.r, size, offset, 2)
+			if err != nil {
+				return nil, err
+			}
+			if header == nil || uint8(header[0]>>24) != AVIIndexOfIndexes {
+				continue
+			}
+			if err := plan.check(r.r, size, fmt.Sprintf("stream %d indx EntriesInUse", i), offset+4, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Apply writes the planned changes. Files that shrink must then be
+// truncated to FileSize by the caller.
+func (p *RepairPlan) Apply(writer io.WriteSeeker) error {
+	for _, change := range p.Changes {
+		if _, err := writer.Seek(change.Offset, io.SeekStart); err != nil {
+			return &AVIError{Op: "seek to " + change.Field, Err: err}
+		}
+		if err := binary.Write(writer, binary.LittleEndian, change.New); err != nil {
+			return &AVIError{Op: "write " + change.Field, Err: err}
+		}
+	}
+
+	if p.IndexRebuilt {
+		if _, err := writer.Seek(p.IndexOffset, io.SeekStart); err != nil {
+			return &AVIError{Op: "seek to idx1", Err: err}
+		}
+		if _, err := writer.Write(p.index); err != nil {
+			return &AVIError{Op: "write idx1", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// RepairFile repairs an AVI file in place
+func RepairFile(filename string) (*RepairPlan, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, &AVIError{Op: "open", Err: err}
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, &AVIError{Op: "stat", Err: err}
+	}
+
+	plan, err := PlanRepair(file, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := plan.Apply(file); err != nil {
+		return nil, err
+	}
+
+	if plan.FileSize != plan.OriginalSize {
+		if err := file.Truncate(plan.FileSize); err != nil {
+			return nil, &AVIError{Op: "truncate", Err: err}
+		}
+	}
+
+	return plan, nil
+}
+
+// check records a change when the uint32 at offset differs from value
+func (p *RepairPlan) check(reader io.ReadSeeker, size int64, field string, offset int64, value uint32) error {
+	values, err := readUint32s(reader, size, offset, 1)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		return &AVIError{Op: "repair", Err: fmt.Errorf("%s is past the end of the file", field)}
+	}
+	if values[0] != value {
+		p.Changes = append(p.Changes, RepairChange{Field: field, Offset: offset, Old: values[0], New: value})
+	}
+	return nil
+}
+
+// locateHeaders walks the hdrl list for the avih, strh, indx and dmlh
+// chunks
+func locateHeaders(reader io.ReadSeeker, size int64) (*headerOffsets, error) {
+	offsets := &headerOffsets{avih: -1, dmlh: -1}
+
+	pos := int64(12)
+	for pos+12 <= size {
+		header, err := readUint32s(reader, size, pos, 3)
+		if err != nil {
+			return nil, err
+		}
+		if ChunkIDToString(idOf(header[0])) == LISTSignature && ChunkIDToString(idOf(header[2])) == HDRLList {
+			end := pos + 8 + int64(header[1])
+			if end > size {
+				end = size
+			}
+			if err := offsets.walk(reader, pos+12, end); err != nil {
+				return nil, err
+			}
+			return offsets, nil
+		}
+		pos += 8 + int64(AlignSize(header[1]))
+	}
+
+	return nil, &AVIError{Op: "repair", Err: fmt.Errorf("no hdrl list found")}
+}
+
+// walk records the header chunks found between start and end, descending
+// into strl and odml lists
+func (o *headerOffsets) walk(reader io.ReadSeeker, start, end int64) error {
+	for pos := start; pos+8 <= end; {
+		header, err := readUint32s(reader, end, pos, 2)
+		if err != nil {
+			return err
+		}
+		next := pos + 8 + int64(AlignSize(header[1]))
+
+		switch ChunkIDToString(idOf(header[0])) {
+		case AVIHChunk:
+			o.avih = pos + 8
+		case STRHChunk:
+			o.strh = append(o.strh, pos+8)
+			o.indx = append(o.indx, -1)
+		case INDXChunk:
+			if len(o.indx) > 0 {
+				o.indx[len(o.indx)-1] = pos + 8
+			}
+		case DMLHChunk:
+			o.dmlh = pos + 8
+		case LISTSignature:
+			listType, err := readUint32s(reader, end, pos+8, 1)
+			if err != nil {
+				return err
+			}
+			if listType == nil {
+				return nil
+			}
+			switch ChunkIDToString(idOf(listType[0])) {
+			case STRLList, ODMLList:
+				if next > end {
+					next = end
+				}
+				if err := o.walk(reader, pos+12, next); err != nil {
+					return err
+				}
+			}
+		}
+
+		pos = next
+	}
+
+	return nil
+}
+
+// moviDataEnd returns the end of the last complete chunk of the movi list,
+// including the ix## and JUNK chunks that follow the last data chunk
+func moviDataEnd(reader io.ReadSeeker, size int64, moviOffset int64, records []indexRecord) (int64, error) {
+	end := moviOffset + 4
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		end = last.position + 8 + int64(AlignSize(last.size))
+	}
+
+	for end+8 <= size {
+		header, err := readUint32s(reader, size, end, 2)
+		if err != nil {
+			return 0, err
+		}
+		id := idOf(header[0])
+		trailing := (id[0] == 'i' && id[1] == 'x') || ChunkIDToString(id) == JUNKChunk
+		next := end + 8 + int64(AlignSize(header[1]))
+		if !trailing || next > size {
+			break
+		}
+		end = next
+	}
+
+	return end, nil
+}
+
+// readUint32s reads count little endian uint32 values at pos, or returns
+// nil when they run past size
+func readUint32s(reader io.ReadSeeker, size int64, pos int64, count int) ([]uint32, error) {
+	if pos+int64(count)*4 > size {
+		return nil, nil
+	}
+	if _, err := reader.Seek(pos, io.SeekStart); err != nil {
+		return nil, &AVIError{Op: "seek", Err: err}
+	}
+	values := make([]uint32, count)
+	if err := binary.Read(reader, binary.LittleEndian, values); err != nil {
+		return nil, &AVIError{Op: "read", Err: err}
+	}
+	return values, nil
+}
+
+// idOf turns a uint32 read in little endian back into a FourCC
+func idOf(value uint32) [4]byte {
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], value)
+	return id
+}
+
+// sameIndex reports whether an idx1 chunk in the file matches the rebuilt
+// one, ignoring flags that were only inferred
+func sameIndex(current, rebuilt []byte) bool {
+	if len(current) != len(rebuilt) || !bytes.Equal(current[:8], rebuilt[:8]) {
+		return false
+	}
+	for i := 8; i+16 <= len(current); i += 16 {
+		if !bytes.Equal(current[i:i+4], rebuilt[i:i+4]) || !bytes.Equal(current[i+8:i+16], rebuilt[i+8:i+16]) {
+			return false
+		}
+	}
+	return true
+}
+
+// streamRecords returns the index records of stream chunks, leaving out
+// rec lists, which OpenDML indexes do not hold
+func streamRecords(records []indexRecord) []indexRecord {
+	var chunks []indexRecord
+	for _, record := range records {
+		if record.flags&AVIIFList == 0 {
+			chunks = append(chunks, record)
+		}
+	}
+	return chunks
+}
+
+// samePositions reports whether two indexes locate the same chunks
+func samePositions(a, b []indexRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].position != b[i].position || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
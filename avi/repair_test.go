@@ -0,0 +1,181 @@
+package avi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairFile(t *testing.T) {
+	data := buildTestAVI(t, 10)
+
+	// Cut the capture off in the middle of the last audio chunk, losing the
+	// standard indexes and idx1, and clear the frame count
+	end := bytes.Index(data, []byte("ix00"))
+	damaged := append([]byte(nil), data[:end-100]...)
+	avih := bytes.Index(damaged, []byte(AVIHChunk))
+	binary.LittleEndian.PutUint32(damaged[avih+8+16:], 0)
+
+	filename := filepath.Join(t.TempDir(), "damaged.avi")
+	if err := os.WriteFile(filename, damaged, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	plan, err := RepairFile(filename)
+	if err != nil {
+		t.Fatalf("RepairFile failed: %v", err)
+	}
+
+	expected := map[string][2]uint32{
+		"avih TotalFrames":           {0, 10},
+		"stream 1 strh Length":       {3200, 2880},
+		"stream 0 indx EntriesInUse": {1, 0},
+		"stream 1 indx EntriesInUse": {1, 0},
+	}
+	for _, change := range plan.Changes {
+		if values, ok := expected[change.Field]; ok {
+			if change.Old != values[0] || change.New != values[1] {
+				t.Errorf("%s: expected %d -> %d, got %d -> %d", change.Field, values[0], values[1], change.Old, change.New)
+			}
+			delete(expected, change.Field)
+		}
+	}
+	for field := range expected {
+		t.Errorf("Expected a change to %s", field)
+	}
+
+	if !plan.IndexRebuilt || plan.OldIndexEntries != 0 || plan.IndexEntries != 19 {
+		t.Errorf("Expected idx1 rebuilt with 19 entries, got %+v", plan)
+	}
+
+	// What is left of the cut off chunk makes way for idx1
+	if lastChunk := int64(8 + 640 - 100); plan.TruncatedOffset != int64(len(damaged))-lastChunk || plan.TruncatedBytes != lastChunk {
+		t.Errorf("Expected a %d byte truncated chunk at %d, got %d at %d", lastChunk, int64(len(damaged))-lastChunk, plan.TruncatedBytes, plan.TruncatedOffset)
+	}
+	if plan.DiscardedBytes != 0 {
+		t.Errorf("Expected nothing discarded past the movi data, got %d bytes at %d", plan.DiscardedBytes, plan.DiscardedOffset)
+	}
+
+	repaired, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read repaired file: %v", err)
+	}
+
+	if int64(len(repaired)) != plan.FileSize {
+		t.Errorf("Expected file size %d, got %d", plan.FileSize, len(repaired))
+	}
+
+	if size := binary.LittleEndian.Uint32(repaired[4:]); int(size) != len(repaired)-8 {
+		t.Errorf("Expected RIFF size %d, got %d", len(repaired)-8, size)
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(repaired), int64(len(repaired))); err != nil {
+		t.Fatalf("Failed to open repaired file: %v", err)
+	}
+
+	packets, err := reader.ReadAllPackets()
+	if err != nil {
+		t.Fatalf("ReadAllPackets on repaired file failed: %v", err)
+	}
+
+	if len(packets) != 19 {
+		t.Errorf("Expected 19 packets, got %d", len(packets))
+	}
+
+	// A second pass has nothing left to fix
+	plan, err = PlanRepair(bytes.NewReader(repaired), int64(len(repaired)))
+	if err != nil {
+		t.Fatalf("PlanRepair on repaired file failed: %v", err)
+	}
+
+	if len(plan.Changes) != 0 || plan.IndexRebuilt || plan.FileSize != plan.OriginalSize {
+		t.Errorf("Expected no changes, got %+v", plan)
+	}
+}
+
+func TestPlanRepairIntactFile(t *testing.T) {
+	data := buildTestAVI(t, 10)
+
+	plan, err := PlanRepair(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("PlanRepair failed: %v", err)
+	}
+
+	if len(plan.Changes) != 0 || plan.IndexRebuilt || plan.FileSize != plan.OriginalSize {
+		t.Errorf("Expected no changes to a muxer written file, got %+v", plan)
+	}
+
+	if plan.Recovery.RecoveredChunks != 20 || plan.Recovery.SkippedBytes != 0 {
+		t.Errorf("Expected a clean scan, got %+v", plan.Recovery)
+	}
+
+	if plan.DiscardedBytes != 0 || plan.TruncatedBytes != 0 {
+		t.Errorf("Expected nothing discarded, got %d bytes at %d and a %d byte truncated chunk", plan.DiscardedBytes, plan.DiscardedOffset, plan.TruncatedBytes)
+	}
+
+	// Anything after idx1 is reported as it is cut off
+	trailing := append(append([]byte(nil), data...), WriteChunkHeader(ChunkHeader{ID: StringToChunkID(JUNKChunk), Size: 8})...)
+	trailing = append(trailing, make([]byte, 8)...)
+	plan, err = PlanRepair(bytes.NewReader(trailing), int64(len(trailing)))
+	if err != nil {
+		t.Fatalf("PlanRepair failed: %v", err)
+	}
+	if plan.DiscardedOffset != int64(len(data)) || plan.DiscardedBytes != 16 {
+		t.Errorf("Expected 16 bytes discarded at %d, got %d at %d", len(data), plan.DiscardedBytes, plan.DiscardedOffset)
+	}
+}
+
+func TestRepairRecLists(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	writer.Create(buffer)
+	writer.SetRecLists(true)
+	writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25})
+	writer.AddStream(Codec{Name: "PCM", Type: StreamTypeAudio, Channels: 1, SampleRate: 8000, BitDepth: 16})
+	for i := 0; i < 10; i++ {
+		writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: bytes.Repeat([]byte{byte(i)}, 101), Flags: PacketKeyframe})
+		writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeAudio, Data: bytes.Repeat([]byte{byte(i)}, 640), Flags: PacketKeyframe})
+	}
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+	data := buffer.Bytes()
+
+	plan, err := PlanRepair(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("PlanRepair failed: %v", err)
+	}
+	if len(plan.Changes) != 0 || plan.IndexRebuilt || plan.IndexEntries != 30 {
+		t.Errorf("Expected no changes to a file with rec lists, got %+v", plan)
+	}
+
+	// Cut the capture off before the last rec list size was patched
+	end := bytes.Index(data, []byte("ix00"))
+	damaged := append([]byte(nil), data[:end]...)
+	last := bytes.LastIndex(damaged, []byte(RECList)) - 4
+	binary.LittleEndian.PutUint32(damaged[last:], 0)
+
+	plan, err = PlanRepair(bytes.NewReader(damaged), int64(len(damaged)))
+	if err != nil {
+		t.Fatalf("PlanRepair failed: %v", err)
+	}
+
+	found := false
+	for _, change := range plan.Changes {
+		if change.Field == "rec LIST size" {
+			found = true
+			if change.Offset != int64(last) || change.Old != 0 || change.New != 4+8+102+8+640 {
+				t.Errorf("Unexpected rec list change %+v", change)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected the last rec list size to be fixed")
+	}
+	if !plan.IndexRebuilt || plan.IndexEntries != 30 {
+		t.Errorf("Expected idx1 rebuilt with 30 entries, got %+v", plan)
+	}
+}
@@ -0,0 +1,293 @@
+package avi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// GAB2 record types
+const (
+	gab2Name     = 0x0002 // Stream name, UTF-16LE and null terminated
+	gab2Subtitle = 0x0004 // Subtitle file, SRT or SSA
+)
+
+// GAB2Subtitle is the payload of a GAB2 subtitle chunk, as written by DivX
+// and VirtualDubMod: a whole subtitle file and the name of its stream
+type GAB2Subtitle struct {
+	Name string // e.g. "English"
+	Data []byte // SRT or SSA file
+}
+
+// SubtitleCue is a subtitle line and the time it is shown
+type SubtitleCue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string // Lines separated by "\n", SSA override tags kept as is
+}
+
+// ParseGAB2 decodes a GAB2 subtitle chunk. ok is false for chunks that do
+// not start with the GAB2 signature.
+func ParseGAB2(data []byte) (GAB2Subtitle, bool) {
+	var subtitle GAB2Subtitle
+	if len(data) < 5 || string(data[:5]) != "GAB2\x00" {
+		return subtitle, false
+	}
+
+	// Records of a 16-bit type and a 32-bit size
+	for pos := 5; pos+6 <= len(data); {
+		recordType := binary.LittleEndian.Uint16(data[pos:])
+		size := int(binary.LittleEndian.Uint32(data[pos+2:]))
+		pos += 6
+		if size < 0 || size > len(data)-pos {
+			size = len(data) - pos
+		}
+		record := data[pos : pos+size]
+		pos += size
+
+		switch recordType {
+		case gab2Name:
+			subtitle.Name = decodeUTF16(record)
+		case gab2Subtitle:
+			subtitle.Data = record
+		}
+	}
+
+	return subtitle, true
+}
+
+// EncodeGAB2 builds a GAB2 subtitle chunk holding a whole SRT or SSA file,
+// to be written as the single packet of a subtitle stream
+func EncodeGAB2(name string, subtitle []byte) []byte {
+	encodedName := utf16.Encode([]rune(name + "\x00"))
+
+	data := []byte("GAB2\x00")
+	data = binary.LittleEndian.AppendUint16(data, gab2Name)
+	data = binary.LittleEndian.AppendUint32(data, uint32(2*len(encodedName)))
+	for _, unit := range encodedName {
+		data = binary.LittleEndian.AppendUint16(data, unit)
+	}
+	data = binary.LittleEndian.AppendUint16(data, gab2Subtitle)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(subtitle)))
+	return append(data, subtitle...)
+}
+
+// decodeUTF16 decodes a null terminated UTF-16LE string
+func decodeUTF16(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := binary.LittleEndian.Uint16(data[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return string(utf16.Decode(units))
+}
+
+// ParseSubtitleCues reads the cues of an SRT or SSA/ASS subtitle file, told
+// apart by the [Events] section of SSA
+func ParseSubtitleCues(data []byte) ([]SubtitleCue, error) {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")) // UTF-8 BOM
+	if bytes.Contains(data, []byte("[Events]")) {
+		return parseSSA(data)
+	}
+	return parseSRT(data)
+}
+
+// parseSRT reads the numbered blocks of an SRT file, each a timing line
+// followed by the text up to the next blank line
+func parseSRT(data []byte) ([]SubtitleCue, error) {
+	var cues []SubtitleCue
+	var cue *SubtitleCue
+	var text []string
+
+	flush := func() {
+		if cue != nil {
+			cue.Text = strings.Join(text, "\n")
+			cues = append(cues, *cue)
+		}
+		cue, text = nil, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case cue == nil && strings.Contains(line, "-->"):
+			times := strings.SplitN(line, "-->", 2)
+			start, err := parseSubtitleTime(times[0], ',')
+			if err != nil {
+				return nil, err
+			}
+			// Coordinates may follow the end time
+			endTime, _, _ := strings.Cut(strings.TrimSpace(times[1]), " ")
+			end, err := parseSubtitleTime(endTime, ',')
+			if err != nil {
+				return nil, err
+			}
+			cue = &SubtitleCue{Start: start, End: end}
+		case cue != nil:
+			text = append(text, line)
+		}
+		// Anything else is a cue number
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, &AVIError{Op: "read srt", Err: err}
+	}
+	return cues, nil
+}
+
+// parseSSA reads the Dialogue lines of an SSA/ASS file's [Events] section,
+// whose Format line gives the field order
+func parseSSA(data []byte) ([]SubtitleCue, error) {
+	var cues []SubtitleCue
+	fields := []string{"Marked", "Start", "End", "Style", "Name", "MarginL", "MarginR", "MarginV", "Effect", "Text"}
+	inEvents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Format":
+			fields = strings.Split(value, ",")
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+		case "Dialogue":
+			// Text is the last field and may hold commas itself
+			values := strings.SplitN(strings.TrimSpace(value), ",", len(fields))
+			var cue SubtitleCue
+			for i, field := range fields {
+				if i >= len(values) {
+					break
+				}
+				var err error
+				switch field {
+				case "Start":
+					cue.Start, err = parseSubtitleTime(values[i], '.')
+				case "End":
+					cue.End, err = parseSubtitleTime(values[i], '.')
+				case "Text":
+					cue.Text = strings.ReplaceAll(strings.ReplaceAll(values[i], `\N`, "\n"), `\n`, "\n")
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			cues = append(cues, cue)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, &AVIError{Op: "read ssa", Err: err}
+	}
+	return cues, nil
+}
+
+// parseSubtitleTime parses an H:MM:SS time whose fraction follows the given
+// separator, e.g. "00:01:02,500" in SRT or "0:01:02.50" in SSA
+func parseSubtitleTime(value string, separator byte) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	clock, fraction, _ := strings.Cut(value, string(separator))
+
+	parts := strings.Split(clock, ":")
+	if len(parts) != 3 {
+		return 0, &AVIError{Op: "parse subtitle time", Err: fmt.Errorf("invalid time %q", value)}
+	}
+
+	var t time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return 0, &AVIError{Op: "parse subtitle time", Err: fmt.Errorf("invalid time %q", value)}
+		}
+		t += time.Duration(n) * unit
+	}
+
+	if fraction != "" {
+		n, err := strconv.Atoi(fraction)
+		if err != nil || n < 0 {
+			return 0, &AVIError{Op: "parse subtitle time", Err: fmt.Errorf("invalid time %q", value)}
+		}
+		unit := time.Second
+		for range fraction {
+			unit /= 10
+		}
+		t += time.Duration(n) * unit
+	}
+
+	return t, nil
+}
+
+// ReadSubtitles returns the cues of a subtitle stream with their times in
+// the file. GAB2 chunks have their embedded SRT or SSA file parsed, with cue
+// times counted from the chunk's own time. Other chunks are a cue each,
+// shown for the chunk's duration.
+func (r *Reader) ReadSubtitles(streamIndex int) ([]SubtitleCue, error) {
+	if r.r == nil || r.fileInfo == nil {
+		return nil, &AVIError{Op: "read subtitles", Err: fmt.Errorf("file not opened")}
+	}
+
+	if streamIndex < 0 || streamIndex >= len(r.streams) || r.streams[streamIndex].Type != StreamTypeSubtitle {
+		return nil, &AVIError{Op: "read subtitles", Err: fmt.Errorf("stream %d is not a subtitle stream", streamIndex)}
+	}
+
+	packets, err := r.ReadAllPackets()
+	if err != nil {
+		return nil, err
+	}
+
+	var cues []SubtitleCue
+	for i := range packets {
+		packet := &packets[i]
+		if packet.StreamIndex != streamIndex {
+			continue
+		}
+
+		data, err := r.ReadPacketData(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		gab2, ok := ParseGAB2(data)
+		if !ok {
+			text := string(bytes.TrimRight(data, "\x00"))
+			cues = append(cues, SubtitleCue{Start: packet.PTSTime, End: packet.PTSTime + packet.DurationTime, Text: text})
+			continue
+		}
+
+		embedded, err := ParseSubtitleCues(gab2.Data)
+		if err != nil {
+			return nil, err
+		}
+		for _, cue := range embedded {
+			cue.Start += packet.PTSTime
+			cue.End += packet.PTSTime
+			cues = append(cues, cue)
+		}
+	}
+
+	return cues, nil
+}
@@ -0,0 +1,134 @@
+package avi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testSRT = "\xEF\xBB\xBF1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\nWorld\r\n\r\n2\r\n00:01:00,040 --> 00:01:01,000 X1:10 X2:20\r\nBye\r\n"
+
+func TestParseSubtitleCues(t *testing.T) {
+	cues, err := ParseSubtitleCues([]byte(testSRT))
+	if err != nil {
+		t.Fatalf("Failed to parse SRT: %v", err)
+	}
+	expected := []SubtitleCue{
+		{Start: time.Second, End: 2500 * time.Millisecond, Text: "Hello\nWorld"},
+		{Start: time.Minute + 40*time.Millisecond, End: time.Minute + time.Second, Text: "Bye"},
+	}
+	if !reflect.DeepEqual(cues, expected) {
+		t.Errorf("Expected SRT cues %+v, got %+v", expected, cues)
+	}
+
+	ssa := "[Script Info]\nTitle: Test\n\n[V4+ Styles]\nFormat: Name, Fontname\nStyle: Default,Arial\n\n[Events]\n" +
+		"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+		"Dialogue: 0,0:00:03.50,0:00:05.00,Default,,0,0,0,,{\\i1}Hi{\\i0}, there\\Nfriend\n"
+	cues, err = ParseSubtitleCues([]byte(ssa))
+	if err != nil {
+		t.Fatalf("Failed to parse SSA: %v", err)
+	}
+	expected = []SubtitleCue{{Start: 3500 * time.Millisecond, End: 5 * time.Second, Text: "{\\i1}Hi{\\i0}, there\nfriend"}}
+	if !reflect.DeepEqual(cues, expected) {
+		t.Errorf("Expected SSA cues %+v, got %+v", expected, cues)
+	}
+
+	if _, err := ParseSubtitleCues([]byte("1\n00:00:xx,000 --> 00:00:01,000\nBad\n")); err == nil {
+		t.Error("Expected error for an invalid SRT time")
+	}
+}
+
+func TestGAB2(t *testing.T) {
+	data := EncodeGAB2("Français", []byte(testSRT))
+
+	subtitle, ok := ParseGAB2(data)
+	if !ok {
+		t.Fatal("Expected a GAB2 chunk")
+	}
+	if subtitle.Name != "Français" || !bytes.Equal(subtitle.Data, []byte(testSRT)) {
+		t.Errorf("Unexpected GAB2 payload %q %q", subtitle.Name, subtitle.Data)
+	}
+
+	if _, ok := ParseGAB2([]byte("Hello")); ok {
+		t.Error("Expected plain text not to parse as GAB2")
+	}
+}
+
+func TestMuxerSubtitles(t *testing.T) {
+	buffer := NewSeekableBuffer()
+	writer := &Writer{}
+	writer.Create(buffer)
+	writer.AddStream(Codec{Name: "MJPG", FourCC: [4]byte{'M', 'J', 'P', 'G'}, Type: StreamTypeVideo, Width: 16, Height: 16, FPS: 25})
+	writer.AddStreamWithHeader(Codec{Type: StreamTypeSubtitle, TimeBase: Rational{Num: 1, Den: 1000}}, StreamHeader{Name: "English"})
+	writer.AddStream(Codec{Type: StreamTypeSubtitle, TimeBase: Rational{Num: 1, Den: 2}})
+
+	if err := writer.WritePacket(&Packet{StreamIndex: 1, Codec: StreamTypeSubtitle, Data: EncodeGAB2("English", []byte(testSRT))}); err != nil {
+		t.Fatalf("Failed to write GAB2 packet: %v", err)
+	}
+	for i := 0; i < 25; i++ {
+		writer.WritePacket(&Packet{StreamIndex: 0, Codec: StreamTypeVideo, Data: make([]byte, 100), Flags: PacketKeyframe})
+	}
+	writer.WritePacket(&Packet{StreamIndex: 2, Codec: StreamTypeSubtitle, Data: []byte("First")})
+	writer.WritePacket(&Packet{StreamIndex: 2, Codec: StreamTypeSubtitle, Data: []byte("Second")})
+	if err := writer.Finalize(); err != nil {
+		t.Fatalf("Failed to finalize: %v", err)
+	}
+
+	data := buffer.Bytes()
+	if !bytes.Contains(data, []byte(STREAMTypeText)) || !bytes.Contains(data, []byte("01tx")) {
+		t.Error("Expected a txts stream with 01tx chunks")
+	}
+
+	reader := &Reader{}
+	if err := reader.Open(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+
+	fileInfo, _ := reader.GetFileInfo()
+	if fileInfo.SubtitleStreams != 2 {
+		t.Errorf("Expected 2 subtitle streams, got %d", fileInfo.SubtitleStreams)
+	}
+	streams, _ := reader.GetStreams()
+	if streams[1].Type != StreamTypeSubtitle || streams[1].Name != "English" || streams[1].Codec.TimeBase != (Rational{Num: 1, Den: 1000}) {
+		t.Errorf("Unexpected subtitle stream %+v", streams[1])
+	}
+
+	packets := readAllSequential(t, reader)
+	var subtitles []*Packet
+	for _, packet := range packets {
+		if packet.Codec == StreamTypeSubtitle {
+			subtitles = append(subtitles, packet)
+		}
+	}
+	if len(packets) != 28 || len(subtitles) != 3 {
+		t.Fatalf("Expected 28 packets of which 3 subtitles, got %d and %d", len(packets), len(subtitles))
+	}
+	if subtitles[2].StreamIndex != 2 || subtitles[2].PTSTime != 500*time.Millisecond || string(subtitles[2].Data) != "Second" {
+		t.Errorf("Unexpected subtitle packet %+v", subtitles[2])
+	}
+
+	cues, err := reader.ReadSubtitles(1)
+	if err != nil {
+		t.Fatalf("ReadSubtitles failed: %v", err)
+	}
+	if len(cues) != 2 || cues[1].Start != time.Minute+40*time.Millisecond || cues[1].Text != "Bye" {
+		t.Errorf("Unexpected GAB2 cues %+v", cues)
+	}
+
+	cues, err = reader.ReadSubtitles(2)
+	if err != nil {
+		t.Fatalf("ReadSubtitles failed: %v", err)
+	}
+	expected := []SubtitleCue{
+		{Start: 0, End: 500 * time.Millisecond, Text: "First"},
+		{Start: 500 * time.Millisecond, End: time.Second, Text: "Second"},
+	}
+	if !reflect.DeepEqual(cues, expected) {
+		t.Errorf("Expected cues %+v, got %+v", expected, cues)
+	}
+
+	if _, err := reader.ReadSubtitles(0); err == nil {
+		t.Error("Expected error for a video stream")
+	}
+}
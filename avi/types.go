@@ -2,6 +2,7 @@ package avi
 
 import (
 	"io"
+	"math"
 	"time"
 )
 
@@ -11,8 +12,75 @@ type StreamType string
 const (
 	StreamTypeVideo StreamType = "video"
 	StreamTypeAudio StreamType = "audio"
+	StreamTypeSubtitle StreamType = "subtitle"
+	StreamTypeData StreamType = "data" // Any other stream (MIDI, timecode, ...), passed through as is
 )
 
+// SeekMode selects where Reader.SeekWithMode positions the reader relative to
+// the requested timestamp
+type SeekMode int
+
+const (
+	// SeekPreviousKeyframe seeks to the last video keyframe at or before the timestamp
+	SeekPreviousKeyframe SeekMode = iota
+	// SeekNearestKeyframe seeks to the video keyframe closest to the timestamp
+	SeekNearestKeyframe
+	// SeekExact seeks to the video frame shown at the timestamp, keyframe or
+	// not. Reading resumes at the keyframe it depends on, with the frames
+	// before it marked PacketDiscard.
+	SeekExact
+)
+
+// Rational is a fraction. As a time base it is the duration of one tick in
+// seconds, strh Scale over Rate.
+type Rational struct {
+	Num int64
+	Den int64
+}
+
+// Valid reports whether both terms are positive
+func (q Rational) Valid() bool {
+	return q.Num > 0 && q.Den > 0
+}
+
+// Float64 returns the value of the fraction
+func (q Rational) Float64() float64 {
+	if q.Den == 0 {
+		return 0
+	}
+	return float64(q.Num) / float64(q.Den)
+}
+
+// Duration converts a number of ticks of the time base to a duration,
+// without overflowing on long streams
+func (q Rational) Duration(ticks int64) time.Duration {
+	if !q.Valid() {
+		return 0
+	}
+	n := ticks * q.Num
+	return time.Duration(n/q.Den)*time.Second + time.Duration(n%q.Den)*time.Second/time.Duration(q.Den)
+}
+
+// Ticks converts a duration to the nearest number of ticks of the time base
+func (q Rational) Ticks(d time.Duration) int64 {
+	if !q.Valid() {
+		return 0
+	}
+	return int64(math.Round(d.Seconds() * float64(q.Den) / float64(q.Num)))
+}
+
+// FrameRateTimeBase returns the time base of a frame rate, recognizing the
+// NTSC rates such as 30000/1001
+func FrameRateTimeBase(fps float64) Rational {
+	if fps <= 0 {
+		return Rational{}
+	}
+	if ntsc := math.Round(fps * 1001 / 1000); ntsc > 0 && math.Abs(fps-ntsc*1000/1001) < 0.0005 {
+		return Rational{Num: 1001, Den: int64(ntsc) * 1000}
+	}
+	return Rational{Num: 1000, Den: int64(math.Round(fps * 1000))}
+}
+
 // Codec represents codec information
 type Codec struct {
 	Name    string
@@ -20,10 +88,25 @@ type Codec struct {
 	Type    StreamType
 	Width   int // for video
 	Height  int // for video
-	FPS     float64 // for video
+	FPS     float64 // for video, TimeBase takes precedence when set
+	TimeBase Rational // Duration of one strh tick, Scale/Rate
 	Channels int // for audio
 	SampleRate int // for audio
 	BitDepth int // for audio
+	FormatTag uint16 // for audio, wFormatTag, derived from Name when 0
+	BlockAlign int // for audio, derived when 0
+	AvgBytesPerSec int // for audio, derived when 0
+	ValidBitsPerSample int // for WAVE_FORMAT_EXTENSIBLE audio, BitDepth when 0
+	ChannelMask uint32 // for WAVE_FORMAT_EXTENSIBLE audio, the usual layout when 0
+	SubFormat [16]byte // for WAVE_FORMAT_EXTENSIBLE audio, derived from FormatTag when zero
+	Uncompressed bool // for video, BI_RGB frames stored in ##db chunks, also implied by a "DIB " FourCC
+	BitCount int // for video, bits per pixel, 24 when 0
+	SizeImage int // for video, derived for uncompressed video when 0
+	VBR bool // for audio, one compressed frame per chunk (MP3, AAC)
+	SamplesPerFrame int // for VBR audio, defaults to 1152 for MP3 and 1024 for AAC
+	ExtraData []byte // Codec private data following the strf format structure
+	Palette []uint32 // Initial palette of paletted video, entries as 0x00RRGGBB
+	RawHeader []byte // for data streams, the strh chunk as read and written back
 }
 
 // Packet represents a single media packet
@@ -36,10 +119,60 @@ type Packet struct {
 	Duration    int64
 	Size        int
 	Position    int64     // position in file
-	Flags       string    // keyframe flags
+	Flags       PacketFlags
 	PTSTime     time.Duration
 	DTSTime     time.Duration
 	DurationTime time.Duration
+	PaletteChanges []PaletteChange // ##pc chunks applying from this video packet on
+	ChunkType string // for data streams, the two-character chunk type, e.g. "tc" for "02tc"
+}
+
+// PaletteChange replaces a range of palette entries of paletted video
+type PaletteChange struct {
+	FirstEntry int      // Index of the first entry replaced
+	Entries    []uint32 // New entries as 0x00RRGGBB, the top byte holds the PALETTEENTRY flags
+}
+
+// PacketFlags describes a packet, mirroring the AVIIF flags of its index entry
+type PacketFlags uint32
+
+const (
+	PacketKeyframe PacketFlags = 1 << iota // Decodable on its own (AVIIF_KEYFRAME)
+	PacketNoTime                           // Does not advance the stream time (AVIIF_NOTIME)
+	PacketList                             // Index entry refers to a LIST (AVIIF_LIST)
+	PacketDiscard                          // Decoded for reference only, not to be presented
+	PacketCorrupt                          // Data is known to be damaged or incomplete
+)
+
+// packetFlags maps idx1 entry flags to packet flags
+func packetFlags(indexFlags uint32) PacketFlags {
+	var flags PacketFlags
+	if indexFlags&AVIIFKeyframe != 0 {
+		flags |= PacketKeyframe
+	}
+	if indexFlags&AVIIFNoTime != 0 {
+		flags |= PacketNoTime
+	}
+	if indexFlags&AVIIFList != 0 {
+		flags |= PacketList
+	}
+	return flags
+}
+
+// indexFlags maps packet flags to idx1 entry flags. Discard and corrupt
+// markers have no index representation and are dropped.
+func (f PacketFlags) indexFlags() uint32 {
+	var flags uint32
+	if f&PacketKeyframe != 0 {
+		flags |= AVIIFKeyframe
+	}
+	if f&PacketNoTime != 0 {
+		flags |= AVIIFNoTime
+	}
+	if f&PacketList != 0 {
+		flags |= AVIIFList
+	}
+	return flags
 }
 
 // Stream represents a media stream
@@ -49,6 +182,29 @@ type Stream struct {
 	Codec     Codec
 	Duration  time.Duration
 	PacketCount int
+	SuggestedBufferSize int // Largest chunk of the stream, from strh
+	StartTime time.Duration // strh Start as time, included in packet timestamps
+	PreRoll time.Duration // InitialFrames as time, how far ahead of the video the stream is interleaved
+	StreamHeader // Name, language, flags and the other strh fields
+}
+
+// StreamHeader holds what describes a stream besides its codec: the strh
+// fields, the strn name and the strd driver data
+type StreamHeader struct {
+	Name          string    // strn, e.g. "English commentary"
+	Flags         uint32    // AVISF flags, e.g. AVISFDisabled
+	Priority      uint16    // The highest priority stream of a type is the default one
+	Language      uint16    // Windows LANGID
+	InitialFrames uint32    // How far the stream is written ahead of the others
+	Start         uint32    // Start time in strh ticks
+	Quality       uint32    // 0 is written as 0xFFFFFFFF, the default quality
+	Frame         FrameRect // Destination rectangle, the video size when empty
+	DriverData    []byte    // strd
+}
+
+// FrameRect is the rcFrame rectangle of a stream
+type FrameRect struct {
+	Left, Top, Right, Bottom int
 }
 
 // FileInfo contains metadata about the AVI file
@@ -59,6 +215,11 @@ type FileInfo struct {
 	Streams     []Stream
 	VideoStreams int
 	AudioStreams int
+	SubtitleStreams int
+	DataStreams int
+	MaxBytesPerSec int // Peak data rate, from avih
+	SuggestedBufferSize int // Largest chunk or rec list, from avih
+	Metadata map[string]string // INFO tags by chunk ID, e.g. "INAM" for the title
 }
 
 // Demuxer interface for reading AVI files
@@ -114,7 +275,51 @@ type Reader struct {
 	streams []Stream
 	fileInfo *FileInfo
 	moviOffset int64 // Offset to movi chunk data
-	indexEntries []IndexEntry // Index entries for seeking
+	microSecPerFrame uint32 // From avih, for the OpenDML frame count
+	segments []moviSegment // movi lists of every RIFF segment, in file order
+	index []indexRecord // Index entries for seeking
+	indexByPosition []indexRecord // index sorted by file position, for flag lookups
+	superIndexes [][]AVISuperIndexEntry // OpenDML super index per stream
+	odmlIndex []indexRecord // OpenDML index entries gathered while parsing
+	recovered bool // Index rebuilt by Recover, ReadPacket follows it
+	readPos int64 // Position of the next chunk read by ReadPacket
+	segment int // Segment holding readPos
+	timing []streamTiming // strh and audio format fields per stream, for timestamps
+	clocks []streamClock // Packets and bytes read so far per stream, used for timestamps
+	skipUntil []int64 // Per stream packet number ReadPacket resumes at after a seek
+	discardUntil []int64 // Per stream packet number up to which packets are marked PacketDiscard after an exact seek
+	palettes [][]PaletteChange // ##pc chunks waiting for the next video packet, per stream
+	pending []*Packet // Packets split from a DV type-1 chunk, returned before reading on
+	seekIndex []Packet // Indexed packets, built on first seek
+}
+
+// streamTiming holds the header fields packet timestamps are derived from
+type streamTiming struct {
+	sampleSize uint32 // strh sample size, 0 when chunks vary in size
+	start int64 // strh Start, added to packet timestamps
+	dvType1 bool // iavs stream, read as video with its audio split off
+	dvInfo DVInfo // strf of a DV type-1 stream
+	dvAudio int // Audio stream split off a DV type-1 stream
+}
+
+// streamClock counts what has been read of a stream
+type streamClock struct {
+	packets int64
+	bytes   int64
+}
+
+// moviSegment is the data area of one movi list
+type moviSegment struct {
+	start int64 // Position of the "movi" list type
+	end   int64 // End of the list data
+}
+
+// indexRecord is a chunk listed by idx1 or an OpenDML index
+type indexRecord struct {
+	chunkID  [4]byte
+	flags    uint32 // idx1 style flags
+	position int64  // Absolute position of the chunk header
+	size     uint32
 }
 
 // Writer wraps an io.WriteSeeker for AVI writing  
@@ -122,5 +327,32 @@ type Writer struct {
 	w io.WriteSeeker
 	filename string
 	streams []Stream
-	packets []Packet
+	finalized bool // Set once Finalize has written the indexes
+	maxRIFFSize int64 // Segment size at which writing rolls over to a RIFF AVIX
+	riffOffset int64 // Position of the current RIFF header
+	hdrlOffset int64 // Position of the hdrl list, rewritten by Finalize
+	moviOffset int64 // Position of the current "movi" list type
+	segments int // RIFF segments started so far
+	segmentIndex [][]indexRecord // Chunks written to the current segment, per stream
+	idx1 []indexRecord // Chunks of the first segment, for the legacy idx1
+	superIndexes [][]AVISuperIndexEntry // ix## chunks written so far, per stream
+	firstSegmentFrames uint32 // Video frames in the first segment, for avih
+	streamBytes []int64 // Payload bytes written per stream, for audio lengths
+	maxInterleave time.Duration // Drift allowed between streams, see SetMaxInterleave
+	queues [][]queuedPacket // Packets held back by the interleaver, per stream
+	queued int64 // Packets queued so far, orders packets with equal times
+	muxTime time.Duration // Latest decode time written
+	interleaved bool // No chunk was written further out of order than the max interleave
+	recLists bool // Wrap each interleave group in a LIST rec
+	recOffset int64 // Position of the open rec list, 0 when none is open
+	recEntry int // idx1 entry of the open rec list, -1 past the first segment
+	maxChunk []uint32 // Largest chunk per stream, for strh buffer sizes
+	maxRecList uint32 // Largest rec list, for the avih buffer size
+	rateWindow []rateSample // Chunks written within the last second of decode time
+	rateBytes int64 // Bytes in rateWindow
+	maxBytesPerSec int64 // Peak of rateBytes, for avih
+	metadata map[string]string // INFO tags, written after hdrl
+	headerGiven []bool // Streams added with a StreamHeader, written as given
+	chunkTypes []string // Chunk type of each data stream's first packet, for its indx
+	audioPreRoll time.Duration // Written as InitialFrames of audio streams
 }
\ No newline at end of file
@@ -187,10 +187,21 @@ func remuxFile(config Config) error {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
 
+	// Keep the INFO tags
+	writer, ok := muxer.(*avi.Writer)
+	if !ok {
+		return fmt.Errorf("internal error: muxer is not a Writer")
+	}
+	for tag, value := range fileInfo.Metadata {
+		if err := writer.SetMetadata(tag, value); err != nil {
+			return fmt.Errorf("failed to set metadata: %w", err)
+		}
+	}
+
 	// Add streams to output
 	streamMapping := make(map[int]int)
 	for _, stream := range streams {
-		newIndex, err := muxer.AddStream(stream.Codec)
+		newIndex, err := writer.AddStreamWithHeader(stream.Codec, stream.StreamHeader)
 		if err != nil {
 			return fmt.Errorf("failed to add stream: %w", err)
 		}
@@ -215,17 +226,19 @@ func remuxFile(config Config) error {
 		
 		// Create new packet with remapped stream index and real data
 		newPacket := &avi.Packet{
-			StreamIndex:  streamMapping[packet.StreamIndex],
-			Codec:        packet.Codec,
-			Data:         packetData,
-			PTS:          packet.PTS,
-			DTS:          packet.DTS,
-			Duration:     packet.Duration,
-			Size:         packet.Size,
-			Flags:        packet.Flags,
-			PTSTime:      packet.PTSTime,
-			DTSTime:      packet.DTSTime,
-			DurationTime: packet.DurationTime,
+			StreamIndex:    streamMapping[packet.StreamIndex],
+			Codec:          packet.Codec,
+			Data:           packetData,
+			PTS:            packet.PTS,
+			DTS:            packet.DTS,
+			Duration:       packet.Duration,
+			Size:           packet.Size,
+			Flags:          packet.Flags,
+			PTSTime:        packet.PTSTime,
+			DTSTime:        packet.DTSTime,
+			DurationTime:   packet.DurationTime,
+			PaletteChanges: packet.PaletteChanges,
+			ChunkType:      packet.ChunkType,
 		}
 
 		if err := muxer.WritePacket(newPacket); err != nil {
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/charlescerisier/avixer/avi"
+)
+
+// Config holds CLI configuration
+type Config struct {
+	InputFile  string
+	OutputFile string
+	InPlace    bool
+	Verbose    bool
+	DryRun     bool
+}
+
+// Version can be set at build time
+var version = "dev"
+
+func main() {
+	config := parseFlags()
+
+	if config.InputFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: input file is required\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Check if input file exists
+	if _, err := os.Stat(config.InputFile); os.IsNotExist(err) {
+		log.Fatalf("Error: input file '%s' does not exist", config.InputFile)
+	}
+
+	if config.InPlace && config.OutputFile != "" {
+		log.Fatalf("Error: -o cannot be used with -in-place")
+	}
+
+	// Set default output file if not specified
+	if config.OutputFile == "" && !config.InPlace {
+		dir := filepath.Dir(config.InputFile)
+		base := filepath.Base(config.InputFile)
+		ext := filepath.Ext(base)
+		name := base[:len(base)-len(ext)]
+		config.OutputFile = filepath.Join(dir, name+"_repaired"+ext)
+	}
+
+	// Perform repair
+	if err := repairFile(config); err != nil {
+		log.Fatalf("Error repairing file: %v", err)
+	}
+}
+
+func parseFlags() Config {
+	var config Config
+
+	flag.StringVar(&config.InputFile, "i", "", "Input AVI file (required)")
+	flag.StringVar(&config.OutputFile, "o", "", "Output AVI file (default: input_repaired.avi)")
+	flag.BoolVar(&config.InPlace, "in-place", false, "Patch the input file instead of writing a copy")
+	flag.BoolVar(&config.Verbose, "v", false, "Verbose output")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Report the changes without writing anything")
+
+	var showVersion bool
+	flag.BoolVar(&showVersion, "version", false, "Show version")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "avirepair %s - AVI file repair tool\n", version)
+		fmt.Fprintf(os.Stderr, "\nUsage: %s [options] -i input.avi\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  %s -i video.avi                    # Repair to video_repaired.avi\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -i video.avi -o fixed.avi       # Specify output file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -i video.avi -in-place          # Patch video.avi itself\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -i video.avi --dry-run          # Report without repairing\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nA last chunk cut off by the end of the file and data after the movi list\n")
+		fmt.Fprintf(os.Stderr, "and idx1 are dropped and reported. OpenDML files with RIFF AVIX segments\n")
+		fmt.Fprintf(os.Stderr, "(over 1 GB) are not supported.\n")
+	}
+
+	flag.Parse()
+
+	if showVersion {
+		fmt.Printf("avirepair %s\n", version)
+		os.Exit(0)
+	}
+
+	return config
+}
+
+func repairFile(config Config) error {
+	if config.DryRun {
+		file, err := os.Open(config.InputFile)
+		if err != nil {
+			return fmt.Errorf("failed to open input file: %w", err)
+		}
+		defer file.Close()
+
+		stat, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat input file: %w", err)
+		}
+
+		plan, err := avi.PlanRepair(file, stat.Size())
+		if err != nil {
+			return fmt.Errorf("failed to analyze input file: %w", err)
+		}
+
+		printReport(config.InputFile, plan, config.Verbose)
+		fmt.Printf("\nDry run complete. No changes written.\n")
+		return nil
+	}
+
+	target := config.InputFile
+	if !config.InPlace {
+		if config.Verbose {
+			fmt.Printf("Copying %s to %s\n", config.InputFile, config.OutputFile)
+		}
+		if err := copyFile(config.InputFile, config.OutputFile); err != nil {
+			return fmt.Errorf("failed to copy input file: %w", err)
+		}
+		target = config.OutputFile
+	}
+
+	plan, err := avi.RepairFile(target)
+	if err != nil {
+		if !config.InPlace {
+			os.Remove(target)
+		}
+		return fmt.Errorf("failed to repair file: %w", err)
+	}
+
+	printReport(target, plan, config.Verbose)
+
+	if len(plan.Changes) == 0 && !plan.IndexRebuilt && plan.FileSize == plan.OriginalSize {
+		fmt.Printf("\n✅ Nothing to repair\n")
+	} else {
+		fmt.Printf("\n✅ Repair completed successfully!\n")
+	}
+
+	return nil
+}
+
+// printReport lists every change of a repair plan
+func printReport(filename string, plan *avi.RepairPlan, verbose bool) {
+	fmt.Printf("\nRepair report for %s:\n", filepath.Base(filename))
+
+	recovery := plan.Recovery
+	fmt.Printf("  Chunks found: %d\n", recovery.RecoveredChunks)
+	if recovery.Resyncs > 0 {
+		fmt.Printf("  Damaged regions skipped: %d\n", recovery.Resyncs)
+	}
+	if recovery.Truncated {
+		fmt.Printf("  Last chunk is cut off by the end of the file\n")
+	}
+	if recovery.SkippedBytes > 0 {
+		fmt.Printf("  Unusable data: %s\n", formatBytes(recovery.SkippedBytes))
+	}
+
+	fmt.Printf("\nChanges:\n")
+	for _, change := range plan.Changes {
+		if verbose {
+			fmt.Printf("  %s: %d -> %d (at offset %d)\n", change.Field, change.Old, change.New, change.Offset)
+		} else {
+			fmt.Printf("  %s: %d -> %d\n", change.Field, change.Old, change.New)
+		}
+	}
+
+	if plan.IndexRebuilt {
+		fmt.Printf("  idx1: %d -> %d entries (at offset %d)\n", plan.OldIndexEntries, plan.IndexEntries, plan.IndexOffset)
+	}
+
+	if plan.FileSize != plan.OriginalSize {
+		fmt.Printf("  File size: %s -> %s\n", formatBytes(plan.OriginalSize), formatBytes(plan.FileSize))
+	}
+
+	if plan.TruncatedBytes > 0 {
+		fmt.Printf("  Dropped: %s of a movi chunk cut off by the end of the file (offsets %d to %d)\n", formatBytes(plan.TruncatedBytes), plan.TruncatedOffset, plan.TruncatedOffset+plan.TruncatedBytes)
+	}
+
+	if plan.DiscardedBytes > 0 {
+		fmt.Printf("  Discarded: %s after the movi list and idx1 (offsets %d to %d)\n", formatBytes(plan.DiscardedBytes), plan.DiscardedOffset, plan.DiscardedOffset+plan.DiscardedBytes)
+	}
+
+	if len(plan.Changes) == 0 && !plan.IndexRebuilt && plan.FileSize == plan.OriginalSize {
+		fmt.Printf("  (none)\n")
+	}
+}
+
+func copyFile(source, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -56,14 +56,37 @@ type StreamInfo struct {
 	Channels   int                    `json:"channels,omitempty"`
 	SampleRate int                    `json:"sample_rate,omitempty"`
 	BitDepth   int                    `json:"bit_depth,omitempty"`
+	StartTime  string                 `json:"start_time"`
 	Duration   string                 `json:"duration,omitempty"`
 	Tags       map[string]interface{} `json:"tags,omitempty"`
 }
 
+// FormatInfo represents container level information for JSON output
+type FormatInfo struct {
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
 // FileOutput represents the complete file information for JSON output
 type FileOutput struct {
 	Streams []StreamInfo `json:"streams,omitempty"`
 	Packets []PacketInfo `json:"packets,omitempty"`
+	Format  *FormatInfo  `json:"format,omitempty"`
+}
+
+// infoTagNames maps INFO chunk IDs to the tag names ffprobe reports
+var infoTagNames = map[string]string{
+	"IART": "artist",
+	"ICMT": "comment",
+	"ICOP": "copyright",
+	"ICRD": "date",
+	"IGNR": "genre",
+	"ILNG": "language",
+	"INAM": "title",
+	"IPRD": "album",
+	"IPRT": "track",
+	"ISFT": "encoder",
+	"ISMP": "timecode",
+	"ITCH": "encoded_by",
 }
 
 func main() {
@@ -179,6 +202,7 @@ func generateJSONOutput(config Config, fileInfo *avi.FileInfo, streams []avi.Str
 				Index:     stream.Index,
 				CodecType: string(stream.Type),
 				CodecName: stream.Codec.Name,
+				StartTime: fmt.Sprintf("%.6f", stream.StartTime.Seconds()),
 				Duration:  stream.Duration.String(),
 				Tags:      make(map[string]interface{}),
 			}
@@ -193,10 +217,25 @@ func generateJSONOutput(config Config, fileInfo *avi.FileInfo, streams []avi.Str
 				streamInfo.BitDepth = stream.Codec.BitDepth
 			}
 
+			if stream.Name != "" {
+				streamInfo.Tags["title"] = stream.Name
+			}
+
 			output.Streams = append(output.Streams, streamInfo)
 		}
 	}
 
+	// Add INFO tags under their ffprobe names
+	if len(fileInfo.Metadata) > 0 {
+		output.Format = &FormatInfo{Tags: make(map[string]string)}
+		for tag, value := range fileInfo.Metadata {
+			if name, ok := infoTagNames[tag]; ok {
+				tag = name
+			}
+			output.Format.Tags[tag] = value
+		}
+	}
+
 	// Add packet information from real file data
 	if config.ShowPackets {
 		packets, err := readRealPackets(demuxer)
@@ -242,7 +281,7 @@ func generateTextOutput(config Config, fileInfo *avi.FileInfo, streams []avi.Str
 	fmt.Fprintf(output, "File: %s\n", filepath.Base(fileInfo.Filename))
 	fmt.Fprintf(output, "Size: %d bytes\n", fileInfo.FileSize)
 	fmt.Fprintf(output, "Duration: %v\n", fileInfo.Duration)
-	fmt.Fprintf(output, "Streams: %d video, %d audio\n\n", fileInfo.VideoStreams, fileInfo.AudioStreams)
+	fmt.Fprintf(output, "Streams: %d video, %d audio, %d subtitle, %d data\n\n", fileInfo.VideoStreams, fileInfo.AudioStreams, fileInfo.SubtitleStreams, fileInfo.DataStreams)
 
 	// Write stream information
 	if config.ShowStreams {
@@ -260,8 +299,15 @@ func generateTextOutput(config Config, fileInfo *avi.FileInfo, streams []avi.Str
 				if stream.Codec.BitDepth > 0 {
 					fmt.Fprintf(output, ", %d bit", stream.Codec.BitDepth)
 				}
+			} else if stream.Type == avi.StreamTypeSubtitle && stream.Name != "" {
+				fmt.Fprintf(output, " (%s)", stream.Name)
+			} else if stream.Type == avi.StreamTypeData && len(stream.Codec.RawHeader) >= 4 {
+				fmt.Fprintf(output, " (%s)", stream.Codec.RawHeader[:4]) // fccType, e.g. mids
 			}
 
+			if stream.StartTime > 0 {
+				fmt.Fprintf(output, ", start: %v", stream.StartTime)
+			}
 			if stream.Duration > 0 {
 				fmt.Fprintf(output, ", duration: %v", stream.Duration)
 			}
@@ -301,6 +347,22 @@ func readRealPackets(demuxer avi.Demuxer) ([]avi.Packet, error) {
 	return reader.ReadAllPackets()
 }
 
+// formatFlags renders packet flags the way ffprobe does, one letter each for
+// keyframe, discard and corrupt
+func formatFlags(flags avi.PacketFlags) string {
+	out := []byte("___")
+	if flags&avi.PacketKeyframe != 0 {
+		out[0] = 'K'
+	}
+	if flags&avi.PacketDiscard != 0 {
+		out[1] = 'D'
+	}
+	if flags&avi.PacketCorrupt != 0 {
+		out[2] = 'C'
+	}
+	return string(out)
+}
+
 // convertPacketsToJSON converts avi.Packet slice to PacketInfo slice for JSON output
 func convertPacketsToJSON(packets []avi.Packet) []PacketInfo {
 	var jsonPackets []PacketInfo
@@ -315,7 +377,7 @@ func convertPacketsToJSON(packets []avi.Packet) []PacketInfo {
 			DurationTime: fmt.Sprintf("%.6f", packet.DurationTime.Seconds()),
 			Size:         fmt.Sprintf("%d", packet.Size),
 			Pos:          fmt.Sprintf("%d", packet.Position),
-			Flags:        packet.Flags,
+			Flags:        formatFlags(packet.Flags),
 		}
 
 		// Add PTS for audio packets or when PTS != DTS
@@ -143,11 +143,11 @@ func writeExample() {
 			PTS:         int64(i),
 			DTS:         int64(i),
 			Duration:    1,
-			Flags:       "K__", // Mark as keyframe
+			Flags:       avi.PacketKeyframe, // Mark as keyframe
 		}
 
 		if i > 0 && i%5 != 0 {
-			videoPacket.Flags = "___" // Non-keyframe
+			videoPacket.Flags = 0 // Non-keyframe
 		}
 
 		err = muxer.WritePacket(videoPacket)
@@ -169,7 +169,7 @@ func writeExample() {
 			PTS:         int64(i * 1024),
 			DTS:         int64(i * 1024),
 			Duration:    1024,
-			Flags:       "K__",
+			Flags:       avi.PacketKeyframe,
 		}
 
 		err = muxer.WritePacket(audioPacket)
@@ -110,11 +110,11 @@ func writeToBuffer() {
 			PTS:         int64(i),
 			DTS:         int64(i),
 			Duration:    1,
-			Flags:       "K__",
+			Flags:       avi.PacketKeyframe,
 		}
 
 		if i > 0 {
-			packet.Flags = "___"
+			packet.Flags = 0
 		}
 
 		err = muxer.WritePacket(packet)